@@ -2,134 +2,411 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
-	pb "github.com/Jille/raft-grpc-example/proto"
-	"github.com/Jille/raft-grpc-leader-rpc/rafterrors"
+	"fmt"
 	"github.com/LaJunkai/drifterdb"
 	"github.com/hashicorp/raft"
 	"io"
-	"log"
+	"sync"
 	"time"
 )
 
 const (
-	OpPut = iota
-	OpDel = iota
-	OpGet = iota
-	OpRol = iota
-	OpCmt = iota
-	OpTrx = iota // 新开事务
+	OpPut            = iota
+	OpDel            = iota
+	OpGet            = iota
+	OpRol            = iota
+	OpCmt            = iota
+	OpTrx            = iota // 新开事务
+	OpBatch          = iota // 在同一个事务中原子地执行多个 put/delete
+	OpTrxKeepAlive   = iota // 续约事务
+	OpTrxExpire      = iota // 由 leader 发起，回滚租约已过期的事务
+	OpCAS            = iota // 当前值等于 CondValue 时写入 Value
+	OpKeyExpire      = iota // 由 leader 发起，删除 Ops 中已过期的 key
+	OpLeaseGrant     = iota // 授予租约
+	OpLeaseRevoke    = iota // 撤销租约并删除挂在其上的 key
+	OpLeaseKeepAlive = iota // 续约租约
+	OpLeaseExpire    = iota // 由 leader 发起，撤销已过期的租约
+	OpIncr           = iota // 原子地给 int 值加上 Delta，返回新值
+	OpJSONMerge      = iota // 将 Value 作为 merge patch 合并到 Path 处，见 jsondoc.go
+	OpJSONSet        = iota // 将 Path 处设为 Value
+	OpJSONRemove     = iota // 删除 Path 处的值
+	OpJSONAppend     = iota // 将 Value 追加到 Path 处的数组
+	OpNodeAdvertise  = iota // 记录节点 Key 对外公布的地址，见 nodes.go
+	OpNodeRemove     = iota // 由 leader 发起，删除已离开集群的节点 Key 的地址
 )
 
-// DrifterX keeps track of the three longest words it ever saw.
+var errTrxNotFound = errors.New("transaction not found")
+
+// DrifterX is the Raft FSM that applies replicated commands to a drifterdb database.
 type DrifterX struct {
 	db drifterdb.BaseDB
+
+	// mtx 保护以下由状态机维护的内存状态，它们会被 Apply 之外的 goroutine 读取
+	mtx        sync.Mutex
+	trxs       map[uint64]*openTrx
+	legacyTrxs map[uint32]uint64        // drifterdb 事务号 -> 事务 ID，仅用于重放旧格式日志
+	expiries   map[string]int64         // 设置了 TTL 的 key -> 过期时间，见 ttl.go
+	leases     map[uint64]*lease        // 见 lease.go
+	keyLeases  map[string]uint64        // 挂在租约上的 key -> 租约 ID
+	nodes      map[string]NodeEndpoints // 节点 ID -> 对外公布的地址
+	applied    uint64                   // 状态机最后应用的日志 index，见 waitForRead
+
+	watch *watchHub
 }
 
 func NewDrifterX(db drifterdb.BaseDB) *DrifterX {
-	return &DrifterX{db: db}
+	return &DrifterX{
+		db:         db,
+		trxs:       map[uint64]*openTrx{},
+		legacyTrxs: map[uint32]uint64{},
+		expiries:   map[string]int64{},
+		leases:     map[uint64]*lease{},
+		keyLeases:  map[string]uint64{},
+		nodes:      map[string]NodeEndpoints{},
+		watch:      newWatchHub(),
+	}
 }
 
-
 var _ raft.FSM = &DrifterX{}
 
-
-
-func LoadCommandFromBytes(b []byte) *Command {
-	c := &Command{}
-	err := json.Unmarshal(b, c)
-	if err != nil {
-		log.Fatalf("unable to parse json command %v", string(b))
-	}
-	return c
+func LoadCommandFromBytes(b []byte) (*Command, error) {
+	return decodeCommand(b)
 }
 
 func (x *DrifterX) Apply(l *raft.Log) interface{} {
-	c := LoadCommandFromBytes(l.Data)
+	x.watch.advance(l.Index)
+	defer x.setApplied(l.Index)
+	c, err := LoadCommandFromBytes(l.Data)
+	if err != nil {
+		// 无法解析的日志不应导致节点退出，将错误返回给提交者
+		return fmt.Errorf("decoding command at index %d: %v", l.Index, err)
+	}
+	x.resolveTrxID(c)
+	c.Revision = l.Index
 	switch c.OpType {
-	case OpPut:
-		{
-			if c.TrxID == 0 { // 未指定事务，开启新事务完成操作
-				return x.db.Put(c.Key, c.Value)
-			} else {
-				if trx := x.db.MapTransaction(c.TrxID); trx != nil {
-					return trx.Put(c.Key, c.Value)
-				} else {
-					return errors.New("未找到指定事务，执行失败")
-				}
-			}
+	case OpPut, OpDel, OpCAS:
+		if err := x.checkLease(c.LeaseID, c.TrxID); err != nil {
+			return err
 		}
-	case OpDel:
-		if c.TrxID == 0 { // 未指定事务，开启新事务完成操作
-			return x.db.Delete(c.Key)
-		} else {
-			if trx := x.db.MapTransaction(c.TrxID); trx != nil {
-				return trx.Delete(c.Key)
-			} else {
-				return errors.New("未找到指定事务，执行失败")
-			}
+		if c.TrxID == 0 { // 未指定事务，直接写入
+			return x.publishChanges(l.Index, [][]byte{c.Key}, func() error {
+				return applyWrite(x.db, c)
+			})
 		}
-
+		trx := x.transaction(c.TrxID)
+		if trx == nil {
+			return errTrxNotFound
+		}
+		if err := applyWrite(trx, c); err != nil {
+			return err
+		}
+		// 事务内的写入在提交时才通知 watcher
+		x.recordTransactionOps(c.TrxID, c)
 	case OpRol:
-		x.db.RollbackTransactionByID(c.TrxID)
+		return x.endTransaction(c.TrxID, l.Index, false)
 	case OpCmt:
-		x.db.CommitTransactionByID(c.TrxID)
+		// 租约已过期但尚未被回收的事务不能再提交
+		if x.expireTransaction(c) {
+			return errTrxNotFound
+		}
+		return x.endTransaction(c.TrxID, l.Index, true)
 	case OpTrx:
-		return x.db.StartTransaction()
+		// 事务 ID 即这条日志的 index，在所有副本上都相同
+		return x.startTransaction(l.Index, c)
+	case OpTrxKeepAlive:
+		info, err := x.keepAliveTransaction(c)
+		if err != nil {
+			return err
+		}
+		return info
+	case OpTrxExpire:
+		return x.expireTransaction(c)
+	case OpBatch:
+		return x.applyBatch(l.Index, c)
+	case OpIncr:
+		return x.applyIncrCommand(l.Index, c)
+	case OpJSONMerge, OpJSONSet, OpJSONRemove, OpJSONAppend:
+		return x.applyJSONCommand(l.Index, c)
+	case OpKeyExpire:
+		return x.expireKeys(l.Index, c)
+	case OpLeaseGrant:
+		// 租约 ID 即这条日志的 index
+		return x.grantLease(l.Index, c)
+	case OpLeaseRevoke:
+		return x.revokeLease(c.LeaseID, l.Index)
+	case OpLeaseKeepAlive:
+		info, err := x.keepAliveLease(c)
+		if err != nil {
+			return err
+		}
+		return info
+	case OpLeaseExpire:
+		return x.expireLease(l.Index, c)
+	case OpNodeAdvertise:
+		return x.advertiseNode(c)
+	case OpNodeRemove:
+		x.removeNode(string(c.Key))
 	}
 	return nil
 }
 
-func (x *DrifterX) Snapshot() (raft.FSMSnapshot, error) {
-	// Make sure that any future calls to f.Apply() don't change the snapshot.
-	return &snapshot{}, nil
+// applyBatch runs every operation of an OpBatch command on a scratch overlay
+// and writes the overlay in a single drifterdb transaction once all of them
+// succeeded. If any operation fails nothing is written and a *BatchError is
+// returned. When the batch names an existing transaction the operations are
+// added to it and left uncommitted.
+func (x *DrifterX) applyBatch(index uint64, c *Command) interface{} {
+	var w kvWriter = x.db
+	if c.TrxID != 0 {
+		trx := x.transaction(c.TrxID)
+		if trx == nil {
+			return errTrxNotFound
+		}
+		w = trx
+	}
+	result := &BatchResult{Index: index, Results: make([]OpResult, len(c.Ops))}
+	for i, op := range c.Ops {
+		result.Results[i].Key = string(op.Key)
+		op.Revision = index
+		op.Time = c.Time
+	}
+	batch := newOverlayWriter(w)
+	failed := false
+	for i, op := range c.Ops {
+		if failed {
+			result.Results[i].Error = "batch aborted"
+			continue
+		}
+		var err error
+		switch op.OpType {
+		case OpPut, OpDel, OpCAS:
+			if err = x.checkLease(op.LeaseID, c.TrxID); err == nil {
+				err = applyWrite(batch, op)
+			}
+		default:
+			err = fmt.Errorf("operation type %d is not allowed in a batch", op.OpType)
+		}
+		if err != nil {
+			result.Results[i].Error = err.Error()
+			failed = true
+		}
+	}
+	if failed {
+		return &BatchError{Results: result.Results}
+	}
+	if c.TrxID != 0 {
+		// 外部事务由客户端负责提交或回滚
+		if err := batch.flush(w); err != nil {
+			return err
+		}
+		x.recordTransactionOps(c.TrxID, c.Ops...)
+		return result
+	}
+	trx := x.db.StartTransaction()
+	err := x.publishChanges(index, commandKeys(c.Ops), func() error {
+		if err := batch.flush(trx); err != nil {
+			x.db.RollbackTransactionByID(trx.TrxID())
+			return err
+		}
+		x.db.CommitTransactionByID(trx.TrxID())
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	result.Committed = true
+	return result
 }
 
-func (x *DrifterX) Restore(r io.ReadCloser) error {
-	//b, err := ioutil.ReadAll(r)
-	//if err != nil {
-	//	return err
-	//}
-	//words := strings.Split(string(b), "\n")
-	//copy(f.words[:], words)
-	return nil
+// BatchError is returned for an OpBatch command of which an operation failed.
+// None of the operations took effect.
+type BatchError struct {
+	// Results holds the error of the failed operation and marks the
+	// operations after it as aborted.
+	Results []OpResult
+}
+
+func (e *BatchError) Error() string {
+	for i, res := range e.Results {
+		if res.Error != "" {
+			return fmt.Sprintf("ops[%d]: %s", i, res.Error)
+		}
+	}
+	return "batch failed"
 }
 
-type snapshot struct {
+// failures returns the operations that failed, without the aborted ones.
+func (e *BatchError) failures() []OpFailure {
+	var failures []OpFailure
+	for i, res := range e.Results {
+		if res.Error != "" && res.Error != "batch aborted" {
+			failures = append(failures, OpFailure{Index: i, Key: res.Key, Error: res.Error})
+		}
+	}
+	return failures
+}
 
+// overlayWriter buffers writes on top of w, so that a batch failing part way
+// leaves w untouched.
+type overlayWriter struct {
+	w      kvReader
+	values map[string][]byte // nil 表示已删除
+	keys   [][]byte          // 按首次写入的顺序
 }
 
-func (s *snapshot) Persist(sink raft.SnapshotSink) error {
-	//_, err := sink.Write([]byte(strings.Join(s.words, "\n")))
-	//if err != nil {
-	//	sink.Cancel()
-	//	return fmt.Errorf("sink.Write(): %v", err)
-	//}
-	return sink.Close()
+func newOverlayWriter(w kvReader) *overlayWriter {
+	return &overlayWriter{w: w, values: map[string][]byte{}}
 }
 
-func (s *snapshot) Release() {
+func (o *overlayWriter) Get(key []byte) []byte {
+	if v, ok := o.values[string(key)]; ok {
+		return v
+	}
+	return o.w.Get(key)
 }
 
+func (o *overlayWriter) Put(key, value []byte) error {
+	o.set(key, value)
+	return nil
+}
 
-type rpcInterface struct {
-	drifterX *DrifterX
-	raft     *raft.Raft
+func (o *overlayWriter) Delete(key []byte) error {
+	o.set(key, nil)
+	return nil
 }
 
-func (r rpcInterface) AddWord(ctx context.Context, req *pb.AddWordRequest) (*pb.AddWordResponse, error) {
-	if r.raft.State() == raft.Leader {
+func (o *overlayWriter) set(key, value []byte) {
+	if _, ok := o.values[string(key)]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[string(key)] = value
+}
 
+// flush performs the buffered writes on w.
+func (o *overlayWriter) flush(w kvWriter) error {
+	for _, key := range o.keys {
+		var err error
+		if value := o.values[string(key)]; value == nil {
+			err = w.Delete(key)
+		} else {
+			err = w.Put(key, value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// errApplyTimeout is returned when the deadline passed after a command was
+// enqueued. The command may still be committed and applied.
+var errApplyTimeout = errors.New("timed out waiting for the write to be applied, it may or may not have been applied")
+
+// applyCommand replicates cmd through Raft and waits until the local FSM
+// applied it, at most until ctx is done or, if ctx has no deadline, for
+// rpcTimeout. Commands are stamped with the leader's time unless they carry
+// one. Errors returned by the FSM are returned as err.
+func applyCommand(ctx context.Context, r *raft.Raft, cmd *Command) (uint64, interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout(ctx))
+	defer cancel()
+	if cmd.Time == 0 {
+		cmd.Time = time.Now().UnixNano()
+	}
+	commandBytes, err := cmd.ToBytes()
+	if err != nil {
+		return 0, nil, err
+	}
+	f := r.Apply(commandBytes, timeout(ctx))
+	// ApplyFuture 只能阻塞等待，在单独的 goroutine 中等待以便响应 ctx
+	done := make(chan error, 1)
+	go func() {
+		done <- f.Error()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return 0, nil, err
+		}
+	case <-ctx.Done():
+		return 0, nil, errApplyTimeout
 	}
-	f := r.raft.Apply([]byte(req.GetWord()), time.Second)
-	if err := f.Error(); err != nil {
-		return nil, rafterrors.MarkRetriable(err)
+	if err, ok := f.Response().(error); ok {
+		return f.Index(), nil, err
 	}
-	return &pb.AddWordResponse{}, nil
+	return f.Index(), f.Response(), nil
 }
 
-func (r rpcInterface) GetWords(ctx context.Context, req *pb.GetWordsRequest) (*pb.GetWordsResponse, error) {
-	// TODO: These two should be read under a mutex to handle concurrent Apply() calls.
-	return &pb.GetWordsResponse{}, nil
+func (x *DrifterX) Snapshot() (raft.FSMSnapshot, error) {
+	// Raft 保证 Snapshot() 与 Apply() 不会并发执行，此处复制出的数据即为当前时刻的一致视图
+	records := append(scanAll(x.db), x.snapshotTransactions()...)
+	records = append(records, x.snapshotLeases()...)
+	records = append(records, x.snapshotNodes()...)
+	return &snapshot{records: records}, nil
+}
+
+// Restore replaces the whole local drifterdb keyspace with the snapshot
+// contents. The snapshot is fully read and verified before anything is
+// deleted, so a corrupted snapshot leaves the local store untouched.
+func (x *DrifterX) Restore(r io.ReadCloser) error {
+	defer r.Close()
+	records, err := readSnapshot(r)
+	if err != nil {
+		return err
+	}
+	for _, existing := range scanAll(x.db) {
+		if err := x.db.Delete(existing.key); err != nil {
+			return fmt.Errorf("clearing key %q before restore: %v", existing.key, err)
+		}
+	}
+	x.resetTransactions()
+	x.resetLeases()
+	x.resetNodes()
+	x.mtx.Lock()
+	x.expiries = map[string]int64{}
+	x.mtx.Unlock()
+	// 恢复快照跳过了中间的变更，watcher 需要重新同步
+	x.watch.reset()
+	// 租约需要先于数据恢复，以便重建挂在租约上的 key
+	for _, rec := range records {
+		if rec.kind == recordLease {
+			if err := x.restoreLease(rec); err != nil {
+				return err
+			}
+		}
+	}
+	var trxRecords []snapshotRecord
+	trxEntries := map[uint64][]*Command{}
+	for _, rec := range records {
+		switch rec.kind {
+		case recordKV:
+			if err := x.db.Put(rec.key, rec.value); err != nil {
+				return fmt.Errorf("restoring key %q: %v", rec.key, err)
+			}
+			if e, err := decodeEntry(rec.value); err == nil {
+				x.trackExpiry(rec.key, e)
+				x.trackLease(rec.key, e)
+			}
+		case recordTrx:
+			trxRecords = append(trxRecords, rec)
+		case recordTrxEntry:
+			if err := restoreTransactionEntry(rec, trxEntries); err != nil {
+				return err
+			}
+		case recordLease:
+		case recordNode:
+			if err := x.restoreNode(rec); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown snapshot record kind %d", rec.kind)
+		}
+	}
+	// 事务需要在全部数据恢复之后重建
+	for _, rec := range trxRecords {
+		if err := x.restoreTransaction(rec, trxEntries); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+// TestBatchInTransactionIsAtomic checks that a batch failing part way inside a
+// transaction leaves none of its writes in the transaction.
+func TestBatchInTransactionIsAtomic(t *testing.T) {
+	c := newTestCluster(t, 1, nil)
+	defer c.shutdown()
+
+	res, err := c.apply(&Command{OpType: OpTrx})
+	if err != nil {
+		t.Fatalf("starting a transaction: %v", err)
+	}
+	trxID := res.(uint64)
+	if _, err := c.apply(&Command{OpType: OpPut, Key: []byte("taken"), Value: []byte("v"), TrxID: trxID}); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	_, err = c.apply(&Command{OpType: OpBatch, TrxID: trxID, Ops: []*Command{
+		{OpType: OpPut, Key: []byte("first"), Value: []byte("v")},
+		{OpType: OpPut, Key: []byte("taken"), Value: []byte("w"), Cond: CondIfAbsent},
+		{OpType: OpDel, Key: []byte("taken")},
+	}})
+	e := toAPIError(err)
+	if e.Code != CodePreconditionFailed {
+		t.Fatalf("failed batch: got %v, want %s", err, CodePreconditionFailed)
+	}
+	if len(e.Failures) != 1 || e.Failures[0].Index != 1 || e.Failures[0].Key != "taken" {
+		t.Errorf("failures: got %+v, want ops[1] on key taken", e.Failures)
+	}
+
+	trx := c.leader().fsm.transaction(trxID)
+	if v := trx.Get([]byte("first")); v != nil {
+		t.Errorf("write before the failed operation is in the transaction: %q", v)
+	}
+	if got, err := getEntry(trx, []byte("taken")); err != nil || got == nil || string(got.Value) != "v" {
+		t.Errorf("key taken: got %+v (%v), want the value put before the batch", got, err)
+	}
+	if _, err := c.apply(&Command{OpType: OpCmt, TrxID: trxID}); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if v := c.leader().fsm.db.Get([]byte("first")); v != nil {
+		t.Errorf("write of the failed batch was committed: %q", v)
+	}
+}
@@ -0,0 +1,287 @@
+// Package client is a Go client for a DrifterX cluster.
+//
+// It talks to the drifterx.KV gRPC service of every node through the multi:///
+// resolver and uses the leader health checks registered by the nodes, so
+// requests are routed to the current leader. Calls rejected because the node
+// was not the leader or no leader was elected are retried with backoff, reads
+// also after any other retriable error. Writes that failed once they may have
+// been applied, e.g. with LEADERSHIP_LOST, are not retried.
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "github.com/Jille/grpc-multi-resolver"
+	pb "github.com/Jille/raft-grpc-example/proto"
+	grpc_retry "github.com/grpc-ecosystem/go-grpc-middleware/retry"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	_ "google.golang.org/grpc/health"
+)
+
+// serviceConfig routes requests to the node that reports the KV service as
+// healthy, which leaderhealth only does on the leader.
+const serviceConfig = `{"healthCheckConfig": {"serviceName": "drifterx.KV"}, "loadBalancingConfig": [ { "round_robin": {} } ]}`
+
+// DefaultTimeout is applied to calls whose context has no deadline.
+const DefaultTimeout = 5 * time.Second
+
+// ErrNotFound is returned by Get when the key does not exist.
+var ErrNotFound = errors.New("key not found")
+
+// Options configure a Client.
+type Options struct {
+	// Timeout is applied to calls whose context has no deadline. Defaults to DefaultTimeout.
+	Timeout time.Duration
+	// MaxRetries bounds the attempts of a call that fails with a retriable
+	// error. Defaults to 5.
+	MaxRetries uint
+	// Backoff is the base of the exponential backoff between retries. Defaults to 100ms.
+	Backoff time.Duration
+	// TLS connects to nodes serving gRPC over TLS. Without it the client
+	// dials without transport security.
+	TLS *tls.Config
+	// DialOptions are appended to the options the client dials with. Set TLS
+	// rather than passing transport credentials here.
+	DialOptions []grpc.DialOption
+}
+
+// Client is safe for concurrent use.
+type Client struct {
+	conn    *grpc.ClientConn
+	kv      pb.KVClient
+	timeout time.Duration
+}
+
+// New connects to the cluster formed by the gRPC addresses of its nodes.
+func New(addrs []string, opts Options) (*Client, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("client: at least one address is required")
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = 5
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = 100 * time.Millisecond
+	}
+	backoff := grpc_retry.BackoffExponential(opts.Backoff)
+	// 流式调用（Range、Watch）都是读请求，可以在任何 Unavailable 错误后重试
+	streamRetryOpts := []grpc_retry.CallOption{
+		grpc_retry.WithBackoff(backoff),
+		grpc_retry.WithMax(opts.MaxRetries),
+		grpc_retry.WithCodes(codes.Unavailable),
+	}
+	security := grpc.WithInsecure()
+	if opts.TLS != nil {
+		security = grpc.WithTransportCredentials(credentials.NewTLS(opts.TLS))
+	}
+	dialOpts := append([]grpc.DialOption{
+		grpc.WithDefaultServiceConfig(serviceConfig),
+		security,
+		grpc.WithDefaultCallOptions(grpc.WaitForReady(true)),
+		grpc.WithUnaryInterceptor(retryUnaryInterceptor(opts.MaxRetries, backoff)),
+		grpc.WithStreamInterceptor(grpc_retry.StreamClientInterceptor(streamRetryOpts...)),
+	}, opts.DialOptions...)
+	conn, err := grpc.Dial("multi:///"+strings.Join(addrs, ","), dialOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("client: dialing %v: %v", addrs, err)
+	}
+	return &Client{
+		conn:    conn,
+		kv:      pb.NewKVClient(conn),
+		timeout: opts.Timeout,
+	}, nil
+}
+
+// Close closes the connections to the cluster.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// KV returns the raw gRPC client, for calls this package does not wrap.
+func (c *Client) KV() pb.KVClient {
+	return c.kv
+}
+
+func (c *Client) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, c.timeout)
+}
+
+// Put stores value under key and returns the commit index. See ToValue for
+// the accepted Go types.
+func (c *Client) Put(ctx context.Context, key string, value interface{}) (uint64, error) {
+	return c.put(ctx, 0, key, value, putOptions{})
+}
+
+// PutTTL stores value under key like Put; the key is deleted once ttl has
+// passed. The TTL is rounded down to whole seconds.
+func (c *Client) PutTTL(ctx context.Context, key string, value interface{}, ttl time.Duration) (uint64, error) {
+	if ttl < time.Second {
+		return 0, fmt.Errorf("ttl %v is shorter than a second", ttl)
+	}
+	return c.put(ctx, 0, key, value, putOptions{ttl: ttl})
+}
+
+// Get reads key as type t at the given consistency.
+func (c *Client) Get(ctx context.Context, key string, t Type, consistency Consistency) (interface{}, error) {
+	return c.get(ctx, 0, key, t, consistency)
+}
+
+// GetKV reads key as type t like Get and also returns its revisions and version.
+func (c *Client) GetKV(ctx context.Context, key string, t Type, consistency Consistency) (KeyValue, error) {
+	return c.getKV(ctx, 0, key, t, consistency)
+}
+
+// Delete removes key and returns the commit index.
+func (c *Client) Delete(ctx context.Context, key string) (uint64, error) {
+	return c.delete(ctx, 0, key, nil)
+}
+
+// Range reads one page of key/value pairs. Pass the returned token as
+// RangeOptions.PageToken to read the next page; it is empty after the last one.
+func (c *Client) Range(ctx context.Context, opts RangeOptions) ([]KeyValue, string, error) {
+	return c.rangePage(ctx, 0, opts)
+}
+
+// putOptions are the optional parts of a put.
+type putOptions struct {
+	cond  *Condition
+	ttl   time.Duration
+	lease uint64
+}
+
+func (c *Client) put(ctx context.Context, trxID uint64, key string, value interface{}, opts putOptions) (uint64, error) {
+	v, err := ToValue(value)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	pc, err := opts.cond.proto()
+	if err != nil {
+		return 0, err
+	}
+	resp, err := c.kv.Put(ctx, &pb.PutRequest{
+		Key:        []byte(key),
+		Value:      v,
+		TrxId:      trxID,
+		Condition:  pc,
+		TtlSeconds: int64(opts.ttl / time.Second),
+		Lease:      opts.lease,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return resp.GetCommitIndex(), nil
+}
+
+func (c *Client) get(ctx context.Context, trxID uint64, key string, t Type, consistency Consistency) (interface{}, error) {
+	kv, err := c.getKV(ctx, trxID, key, t, consistency)
+	if err != nil {
+		return nil, err
+	}
+	return kv.Value, nil
+}
+
+func (c *Client) getKV(ctx context.Context, trxID uint64, key string, t Type, consistency Consistency) (KeyValue, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	resp, err := c.kv.Get(ctx, &pb.GetRequest{
+		Key:         []byte(key),
+		Type:        string(t),
+		TrxId:       trxID,
+		Consistency: pb.Consistency(consistency),
+	})
+	if err != nil {
+		return KeyValue{}, err
+	}
+	if !resp.GetFound() {
+		return KeyValue{}, ErrNotFound
+	}
+	return fromKeyValue(resp.GetKv())
+}
+
+func (c *Client) delete(ctx context.Context, trxID uint64, key string, cond *Condition) (uint64, error) {
+	pc, err := cond.proto()
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	resp, err := c.kv.Delete(ctx, &pb.DeleteRequest{Key: []byte(key), TrxId: trxID, Condition: pc})
+	if err != nil {
+		return 0, err
+	}
+	return resp.GetCommitIndex(), nil
+}
+
+func (c *Client) rangePage(ctx context.Context, trxID uint64, opts RangeOptions) ([]KeyValue, string, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	resp, err := c.kv.Range(ctx, &pb.RangeRequest{
+		StartKey:    []byte(opts.StartKey),
+		EndKey:      []byte(opts.EndKey),
+		Prefix:      []byte(opts.Prefix),
+		Reverse:     opts.Reverse,
+		Limit:       int32(opts.Limit),
+		PageToken:   opts.PageToken,
+		Type:        string(opts.Type),
+		TrxId:       trxID,
+		Consistency: pb.Consistency(opts.Consistency),
+		Fields:      opts.Fields,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	kvs := make([]KeyValue, 0, len(resp.GetKvs()))
+	for _, kv := range resp.GetKvs() {
+		decoded, err := fromKeyValue(kv)
+		if err != nil {
+			return nil, "", err
+		}
+		kvs = append(kvs, decoded)
+	}
+	return kvs, resp.GetNextPageToken(), nil
+}
+
+// IncrOptions are the optional parts of an increment.
+type IncrOptions struct {
+	// Initial is the value of the counter before the increment if the key
+	// does not exist.
+	Initial int64
+	// Min and Max, if set, bound the result. An increment that would leave
+	// the bounds fails with codes.OutOfRange and leaves the counter unchanged.
+	Min, Max *int64
+}
+
+// Incr atomically adds delta to the int stored under key and returns the new
+// value. It fails with codes.FailedPrecondition if the stored value is not an
+// int and with codes.OutOfRange on overflow.
+func (c *Client) Incr(ctx context.Context, key string, delta int64, opts IncrOptions) (int64, error) {
+	req := &pb.IncrementRequest{Key: []byte(key), Delta: delta, Initial: opts.Initial}
+	if opts.Min != nil {
+		req.HasMin, req.Min = true, *opts.Min
+	}
+	if opts.Max != nil {
+		req.HasMax, req.Max = true, *opts.Max
+	}
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	resp, err := c.kv.Increment(ctx, req)
+	if err != nil {
+		return 0, err
+	}
+	return resp.GetValue(), nil
+}
@@ -0,0 +1,82 @@
+package client
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	pb "github.com/Jille/raft-grpc-example/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// deleteServer answers every Delete with commit index 1.
+type deleteServer struct {
+	pb.UnimplementedKVServer
+}
+
+func (*deleteServer) Delete(context.Context, *pb.DeleteRequest) (*pb.DeleteResponse, error) {
+	return &pb.DeleteResponse{CommitIndex: 1}, nil
+}
+
+// selfSignedCert returns a certificate for 127.0.0.1 and the pool that
+// trusts it.
+func selfSignedCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// TestTLS checks that the client reaches a node serving gRPC over TLS.
+func TestTLS(t *testing.T) {
+	cert, pool := selfSignedCert(t)
+	sock, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer(grpc.Creds(credentials.NewTLS(&tls.Config{Certificates: []tls.Certificate{cert}})))
+	pb.RegisterKVServer(s, &deleteServer{})
+	hs := health.NewServer()
+	hs.SetServingStatus("drifterx.KV", healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(s, hs)
+	go s.Serve(sock)
+	defer s.Stop()
+
+	c, err := New([]string{sock.Addr().String()}, Options{TLS: &tls.Config{RootCAs: pool}, Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer c.Close()
+	index, err := c.Delete(context.Background(), "k")
+	if err != nil || index != 1 {
+		t.Fatalf("Delete over TLS: got %d, %v", index, err)
+	}
+}
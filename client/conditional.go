@@ -0,0 +1,103 @@
+package client
+
+import (
+	"context"
+
+	pb "github.com/Jille/raft-grpc-example/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Condition makes a write conditional on the current state of its key. Use
+// IfAbsent, IfValueEquals, IfVersionEquals or IfModRevisionEquals to build one.
+type Condition struct {
+	absent      bool
+	value       interface{}
+	version     *uint64
+	modRevision *uint64
+}
+
+// IfAbsent holds if the key does not exist.
+func IfAbsent() *Condition {
+	return &Condition{absent: true}
+}
+
+// IfValueEquals holds if the key exists and its value equals v. See ToValue
+// for the accepted Go types.
+func IfValueEquals(v interface{}) *Condition {
+	return &Condition{value: v}
+}
+
+// IfVersionEquals holds if the version of the key equals version. Version 0
+// means the key does not exist.
+func IfVersionEquals(version uint64) *Condition {
+	return &Condition{version: &version}
+}
+
+// IfModRevisionEquals holds if the mod revision of the key equals rev.
+// Revision 0 means the key does not exist.
+func IfModRevisionEquals(rev uint64) *Condition {
+	return &Condition{modRevision: &rev}
+}
+
+func (cond *Condition) proto() (*pb.Condition, error) {
+	switch {
+	case cond == nil:
+		return nil, nil
+	case cond.absent:
+		return &pb.Condition{Kind: &pb.Condition_IfAbsent{IfAbsent: true}}, nil
+	case cond.version != nil:
+		return &pb.Condition{Kind: &pb.Condition_IfVersionEquals{IfVersionEquals: *cond.version}}, nil
+	case cond.modRevision != nil:
+		return &pb.Condition{Kind: &pb.Condition_IfModRevisionEquals{IfModRevisionEquals: *cond.modRevision}}, nil
+	}
+	v, err := ToValue(cond.value)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.Condition{Kind: &pb.Condition_IfValueEquals{IfValueEquals: v}}, nil
+}
+
+// IsPreconditionFailed reports whether err is the error of a conditional
+// write whose condition did not hold.
+func IsPreconditionFailed(err error) bool {
+	code := ErrorCode(err)
+	// 旧版本服务端的错误不带错误码
+	return code == "PRECONDITION_FAILED" || (code == "" && status.Code(err) == codes.FailedPrecondition)
+}
+
+// PutIf stores value under key if cond holds and returns the commit index.
+func (c *Client) PutIf(ctx context.Context, key string, value interface{}, cond *Condition) (uint64, error) {
+	return c.put(ctx, 0, key, value, putOptions{cond: cond})
+}
+
+// DeleteIf removes key if cond holds and returns the commit index.
+func (c *Client) DeleteIf(ctx context.Context, key string, cond *Condition) (uint64, error) {
+	return c.delete(ctx, 0, key, cond)
+}
+
+// CompareAndSwap stores value under key if the key currently holds expected,
+// or does not exist when expected is nil, and returns the commit index.
+func (c *Client) CompareAndSwap(ctx context.Context, key string, expected, value interface{}) (uint64, error) {
+	return c.compareAndSwap(ctx, 0, key, expected, value)
+}
+
+func (c *Client) compareAndSwap(ctx context.Context, trxID uint64, key string, expected, value interface{}) (uint64, error) {
+	v, err := ToValue(value)
+	if err != nil {
+		return 0, err
+	}
+	req := &pb.CompareAndSwapRequest{Key: []byte(key), Value: v, TrxId: trxID}
+	if expected != nil {
+		if req.Expected, err = ToValue(expected); err != nil {
+			return 0, err
+		}
+	}
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	resp, err := c.kv.CompareAndSwap(ctx, req)
+	if err != nil {
+		return 0, err
+	}
+	return resp.GetCommitIndex(), nil
+}
@@ -0,0 +1,33 @@
+package client
+
+import (
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/status"
+)
+
+// errorDomain is the domain of the ErrorInfo details of drifterx errors.
+const errorDomain = "drifterx"
+
+// ErrorCode returns the stable error code of an error returned by the server,
+// such as "NOT_LEADER" or "TYPE_MISMATCH", or "" if err carries none.
+func ErrorCode(err error) string {
+	if info := errorInfo(err); info != nil {
+		return info.GetReason()
+	}
+	return ""
+}
+
+// LeaderAddress returns the address of the leader named by a NOT_LEADER error,
+// or "" if err does not name one.
+func LeaderAddress(err error) string {
+	return errorInfo(err).GetMetadata()["leader"]
+}
+
+func errorInfo(err error) *errdetails.ErrorInfo {
+	for _, d := range status.Convert(err).Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok && info.GetDomain() == errorDomain {
+			return info
+		}
+	}
+	return nil
+}
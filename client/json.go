@@ -0,0 +1,75 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	pb "github.com/Jille/raft-grpc-example/proto"
+)
+
+// MergeJSON applies patch as a JSON merge patch (RFC 7396) to the value at
+// path, a JSON pointer that is empty for the whole document, of the json
+// document stored under key. A missing key is treated as null. It returns the
+// resulting document.
+func (c *Client) MergeJSON(ctx context.Context, key, path string, patch interface{}) (json.RawMessage, error) {
+	return c.updateJSON(ctx, key, pb.UpdateJSONRequest_MERGE, path, patch)
+}
+
+// SetJSON replaces the value at path of the json document stored under key,
+// adding it if it does not exist. Its parent must exist.
+func (c *Client) SetJSON(ctx context.Context, key, path string, value interface{}) (json.RawMessage, error) {
+	return c.updateJSON(ctx, key, pb.UpdateJSONRequest_SET, path, value)
+}
+
+// RemoveJSON removes the value at path of the json document stored under key.
+func (c *Client) RemoveJSON(ctx context.Context, key, path string) (json.RawMessage, error) {
+	return c.updateJSON(ctx, key, pb.UpdateJSONRequest_REMOVE, path, nil)
+}
+
+// AppendJSON appends value to the array at path of the json document stored
+// under key, creating the array if it does not exist.
+func (c *Client) AppendJSON(ctx context.Context, key, path string, value interface{}) (json.RawMessage, error) {
+	return c.updateJSON(ctx, key, pb.UpdateJSONRequest_APPEND, path, value)
+}
+
+// GetFields reads the fields at the given JSON pointers from the json or list
+// value stored under key. Fields that do not exist are left out.
+func (c *Client) GetFields(ctx context.Context, key string, fields []string, consistency Consistency) (map[string]json.RawMessage, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	resp, err := c.kv.Get(ctx, &pb.GetRequest{
+		Key:         []byte(key),
+		Consistency: pb.Consistency(consistency),
+		Fields:      fields,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !resp.GetFound() {
+		return nil, ErrNotFound
+	}
+	var res map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(resp.GetKv().GetValue().GetJsonValue()), &res); err != nil {
+		return nil, fmt.Errorf("client: decoding fields: %v", err)
+	}
+	return res, nil
+}
+
+func (c *Client) updateJSON(ctx context.Context, key string, op pb.UpdateJSONRequest_Op, path string, value interface{}) (json.RawMessage, error) {
+	req := &pb.UpdateJSONRequest{Key: []byte(key), Op: op, Path: path}
+	if op != pb.UpdateJSONRequest_REMOVE {
+		b, err := json.Marshal(value)
+		if err != nil {
+			return nil, fmt.Errorf("client: encoding %T as json: %v", value, err)
+		}
+		req.Value = string(b)
+	}
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	resp, err := c.kv.UpdateJSON(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(resp.GetValue()), nil
+}
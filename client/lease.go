@@ -0,0 +1,78 @@
+package client
+
+import (
+	"context"
+	"time"
+
+	pb "github.com/Jille/raft-grpc-example/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Lease is a lease granted by the cluster. Keys put with it are deleted when
+// it is revoked or its TTL runs out without a keepalive.
+type Lease struct {
+	c   *Client
+	ID  uint64
+	TTL time.Duration
+}
+
+// Grant grants a lease with the given TTL; zero uses the server default.
+func (c *Client) Grant(ctx context.Context, ttl time.Duration) (*Lease, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	resp, err := c.kv.LeaseGrant(ctx, &pb.LeaseGrantRequest{TtlSeconds: uint32(ttl / time.Second)})
+	if err != nil {
+		return nil, err
+	}
+	l := resp.GetLease()
+	return &Lease{c: c, ID: l.GetId(), TTL: time.Duration(l.GetTtlSeconds()) * time.Second}, nil
+}
+
+// Put stores value under key attached to the lease.
+func (l *Lease) Put(ctx context.Context, key string, value interface{}) (uint64, error) {
+	return l.c.put(ctx, 0, key, value, putOptions{lease: l.ID})
+}
+
+// PutIf stores value under key attached to the lease if cond holds.
+func (l *Lease) PutIf(ctx context.Context, key string, value interface{}, cond *Condition) (uint64, error) {
+	return l.c.put(ctx, 0, key, value, putOptions{lease: l.ID, cond: cond})
+}
+
+// KeepAlive renews the lease.
+func (l *Lease) KeepAlive(ctx context.Context) error {
+	ctx, cancel := l.c.withTimeout(ctx)
+	defer cancel()
+	_, err := l.c.kv.LeaseKeepAlive(ctx, &pb.LeaseKeepAliveRequest{Id: l.ID})
+	return err
+}
+
+// KeepAliveLoop renews the lease every third of its TTL until ctx is done or
+// the lease no longer exists, and returns the error that ended it. Other
+// failures are retried at the next tick.
+func (l *Lease) KeepAliveLoop(ctx context.Context) error {
+	interval := l.TTL / 3
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if err := l.KeepAlive(ctx); status.Code(err) == codes.NotFound {
+				return err
+			}
+		}
+	}
+}
+
+// Revoke revokes the lease and deletes every key attached to it.
+func (l *Lease) Revoke(ctx context.Context) error {
+	ctx, cancel := l.c.withTimeout(ctx)
+	defer cancel()
+	_, err := l.c.kv.LeaseRevoke(ctx, &pb.LeaseRevokeRequest{Id: l.ID})
+	return err
+}
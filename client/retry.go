@@ -0,0 +1,65 @@
+package client
+
+import (
+	"context"
+	"time"
+
+	grpc_retry "github.com/grpc-ecosystem/go-grpc-middleware/retry"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// 只有 NOT_LEADER 与 NO_LEADER 能确定请求没有生效，写请求只在这两种错误时重试。
+// LEADERSHIP_LOST 等错误发生时写入可能已经生效，重试会使 Incr、开启事务等
+// 操作重复执行，也会使条件写入因自己的上一次写入而失败，因此只重试幂等的读请求。
+
+// idempotentMethods are the KV calls that may be retried after any retriable
+// error.
+var idempotentMethods = map[string]bool{
+	"/drifterx.KV/Get":         true,
+	"/drifterx.KV/Range":       true,
+	"/drifterx.KV/RangeStream": true,
+	"/drifterx.KV/Watch":       true,
+	"/drifterx.KV/Leases":      true,
+}
+
+// shouldRetry reports whether a call of method that failed with err may be
+// sent again.
+func shouldRetry(method string, err error) bool {
+	if status.Code(err) != codes.Unavailable {
+		return false
+	}
+	if idempotentMethods[method] {
+		return true
+	}
+	switch ErrorCode(err) {
+	case "NOT_LEADER", "NO_LEADER":
+		return true
+	}
+	return false
+}
+
+// retryUnaryInterceptor makes up to max attempts of a call, see shouldRetry,
+// waiting backoff between them.
+func retryUnaryInterceptor(max uint, backoff grpc_retry.BackoffFunc) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		var err error
+		for attempt := uint(0); attempt < max; attempt++ {
+			if attempt > 0 {
+				timer := time.NewTimer(backoff(attempt))
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return err
+				case <-timer.C:
+				}
+			}
+			err = invoker(ctx, method, req, reply, cc, opts...)
+			if err == nil || !shouldRetry(method, err) {
+				return err
+			}
+		}
+		return err
+	}
+}
@@ -0,0 +1,41 @@
+package client
+
+import (
+	"errors"
+	"testing"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func statusError(code codes.Code, reason string) error {
+	st := status.New(code, reason)
+	if reason != "" {
+		st, _ = st.WithDetails(&errdetails.ErrorInfo{Reason: reason, Domain: errorDomain})
+	}
+	return st.Err()
+}
+
+func TestShouldRetry(t *testing.T) {
+	for _, tc := range []struct {
+		method string
+		err    error
+		want   bool
+	}{
+		{"/drifterx.KV/Increment", statusError(codes.Unavailable, "NOT_LEADER"), true},
+		{"/drifterx.KV/Increment", statusError(codes.Unavailable, "NO_LEADER"), true},
+		{"/drifterx.KV/Increment", statusError(codes.Unavailable, "LEADERSHIP_LOST"), false},
+		{"/drifterx.KV/Put", statusError(codes.Unavailable, "FORWARD_FAILED"), false},
+		{"/drifterx.KV/BeginTransaction", statusError(codes.Unavailable, ""), false},
+		{"/drifterx.KV/Get", statusError(codes.Unavailable, "LEADERSHIP_LOST"), true},
+		{"/drifterx.KV/Range", statusError(codes.Unavailable, ""), true},
+		{"/drifterx.KV/Get", statusError(codes.DeadlineExceeded, "TIMEOUT"), false},
+		{"/drifterx.KV/Put", statusError(codes.FailedPrecondition, "PRECONDITION_FAILED"), false},
+		{"/drifterx.KV/Get", errors.New("not a status"), false},
+	} {
+		if got := shouldRetry(tc.method, tc.err); got != tc.want {
+			t.Errorf("shouldRetry(%s, %v) = %v, want %v", tc.method, tc.err, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	pb "github.com/Jille/raft-grpc-example/proto"
+)
+
+// Tx is an open transaction. Its methods run inside the transaction; reads
+// observe the transaction's own uncommitted writes.
+type Tx struct {
+	c   *Client
+	ID  uint64
+	TTL time.Duration
+}
+
+func (tx *Tx) Put(ctx context.Context, key string, value interface{}) (uint64, error) {
+	return tx.c.put(ctx, tx.ID, key, value, putOptions{})
+}
+
+func (tx *Tx) Get(ctx context.Context, key string, t Type) (interface{}, error) {
+	return tx.c.get(ctx, tx.ID, key, t, Linearizable)
+}
+
+func (tx *Tx) Delete(ctx context.Context, key string) (uint64, error) {
+	return tx.c.delete(ctx, tx.ID, key, nil)
+}
+
+func (tx *Tx) Range(ctx context.Context, opts RangeOptions) ([]KeyValue, string, error) {
+	return tx.c.rangePage(ctx, tx.ID, opts)
+}
+
+// Begin opens a transaction with the given lease; zero uses the server default.
+// The caller must keep it alive with KeepAlive and end it with Commit or Rollback.
+func (c *Client) Begin(ctx context.Context, ttl time.Duration) (*Tx, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	resp, err := c.kv.BeginTransaction(ctx, &pb.BeginTransactionRequest{TtlSeconds: uint32(ttl / time.Second)})
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{c: c, ID: resp.GetTrxId(), TTL: time.Duration(resp.GetTtlSeconds()) * time.Second}, nil
+}
+
+// KeepAlive renews the lease of the transaction.
+func (tx *Tx) KeepAlive(ctx context.Context) error {
+	ctx, cancel := tx.c.withTimeout(ctx)
+	defer cancel()
+	_, err := tx.c.kv.KeepAliveTransaction(ctx, &pb.KeepAliveTransactionRequest{TrxId: tx.ID})
+	return err
+}
+
+// Commit commits the transaction and returns the commit index.
+func (tx *Tx) Commit(ctx context.Context) (uint64, error) {
+	ctx, cancel := tx.c.withTimeout(ctx)
+	defer cancel()
+	resp, err := tx.c.kv.Commit(ctx, &pb.CommitRequest{TrxId: tx.ID})
+	if err != nil {
+		return 0, err
+	}
+	return resp.GetCommitIndex(), nil
+}
+
+// Rollback discards every write of the transaction.
+func (tx *Tx) Rollback(ctx context.Context) error {
+	ctx, cancel := tx.c.withTimeout(ctx)
+	defer cancel()
+	_, err := tx.c.kv.Rollback(ctx, &pb.RollbackRequest{TrxId: tx.ID})
+	return err
+}
+
+// Txn begins a transaction, runs fn in it and commits if fn returns nil. If fn
+// returns an error or panics, the transaction is rolled back and the error is
+// returned. The lease is kept alive while fn runs.
+func (c *Client) Txn(ctx context.Context, fn func(ctx context.Context, tx *Tx) error) (err error) {
+	tx, err := c.Begin(ctx, 0)
+	if err != nil {
+		return err
+	}
+	stop := make(chan struct{})
+	go tx.keepAliveUntil(ctx, stop)
+	defer func() {
+		close(stop)
+		if r := recover(); r != nil {
+			tx.Rollback(context.Background())
+			panic(r)
+		}
+		if err != nil {
+			if rerr := tx.Rollback(context.Background()); rerr != nil {
+				err = fmt.Errorf("%v (rollback failed: %v)", err, rerr)
+			}
+		}
+	}()
+	if err = fn(ctx, tx); err != nil {
+		return err
+	}
+	_, err = tx.Commit(ctx)
+	return err
+}
+
+func (tx *Tx) keepAliveUntil(ctx context.Context, stop <-chan struct{}) {
+	interval := tx.TTL / 3
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			tx.KeepAlive(ctx)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	pb "github.com/Jille/raft-grpc-example/proto"
+)
+
+// Type is the representation a value is read as, mirroring the server's
+// ValueTypes. Values are read as the type they were written with, so reads
+// only need a type for values written before the server stored types.
+type Type string
+
+const (
+	// TypeStored reads values as the type they were written with.
+	TypeStored    Type = ""
+	TypeInt       Type = "int"
+	TypeFloat     Type = "float"
+	TypeString    Type = "string"
+	TypeBool      Type = "bool"
+	TypeBytes     Type = "bytes"
+	TypeTimestamp Type = "timestamp"
+	TypeList      Type = "list"
+	TypeJSON      Type = "json"
+)
+
+// Consistency selects how up to date a read must be.
+type Consistency int32
+
+const (
+	// Linearizable reads are served by the leader after it confirmed its
+	// leadership and observe every write committed before the read started.
+	Linearizable = Consistency(pb.Consistency_LINEARIZABLE)
+	// Leader reads are served by the node that believes it is the leader.
+	Leader = Consistency(pb.Consistency_LEADER)
+	// Stale reads may be served by any node and can return old values.
+	Stale = Consistency(pb.Consistency_STALE)
+)
+
+// KeyValue is a decoded key/value pair together with the metadata of the key.
+type KeyValue struct {
+	Key   string
+	Value interface{}
+	// CreateRevision and ModRevision are the log indexes of the write that
+	// created the key and of its last write.
+	CreateRevision uint64
+	ModRevision    uint64
+	// Version counts the writes since the key was created, starting at 1.
+	Version uint64
+	// ExpiresAt is when the key expires, zero if it does not.
+	ExpiresAt time.Time
+	// Lease is the lease the key is attached to, 0 if none.
+	Lease uint64
+	// Type is the type the value was read as.
+	Type Type
+}
+
+func fromKeyValue(kv *pb.KeyValue) (KeyValue, error) {
+	v, err := FromValue(kv.GetValue())
+	if err != nil {
+		return KeyValue{}, err
+	}
+	res := KeyValue{
+		Key:            string(kv.GetKey()),
+		Value:          v,
+		CreateRevision: kv.GetCreateRevision(),
+		ModRevision:    kv.GetModRevision(),
+		Version:        kv.GetVersion(),
+		Lease:          kv.GetLease(),
+		Type:           Type(kv.GetType()),
+	}
+	if kv.GetExpiresAt() != 0 {
+		res.ExpiresAt = time.Unix(0, kv.GetExpiresAt())
+	}
+	return res, nil
+}
+
+// RangeOptions describe a range read.
+type RangeOptions struct {
+	// StartKey is inclusive, EndKey exclusive. An empty EndKey reads to the
+	// end of the keyspace.
+	StartKey    string
+	EndKey      string
+	Prefix      string
+	Reverse     bool
+	Limit       int
+	PageToken   string
+	Type        Type
+	Consistency Consistency
+	// Fields, if set, are the JSON pointers of the fields to return from json
+	// and list values. Each value becomes a json.RawMessage of an object
+	// mapping every field found to its value.
+	Fields []string
+}
+
+// ToValue converts a Go value to a typed value. Integers are stored as int,
+// floats as float, strings as string, booleans as bool, []byte as bytes,
+// time.Time as timestamp, json.RawMessage verbatim as json, other slices and
+// arrays JSON encoded as list and anything else JSON encoded as json.
+func ToValue(v interface{}) (*pb.Value, error) {
+	switch v := v.(type) {
+	case *pb.Value:
+		return v, nil
+	case int:
+		return &pb.Value{Kind: &pb.Value_IntValue{IntValue: int64(v)}}, nil
+	case int32:
+		return &pb.Value{Kind: &pb.Value_IntValue{IntValue: int64(v)}}, nil
+	case int64:
+		return &pb.Value{Kind: &pb.Value_IntValue{IntValue: v}}, nil
+	case uint32:
+		return &pb.Value{Kind: &pb.Value_IntValue{IntValue: int64(v)}}, nil
+	case float32:
+		return &pb.Value{Kind: &pb.Value_FloatValue{FloatValue: float64(v)}}, nil
+	case float64:
+		return &pb.Value{Kind: &pb.Value_FloatValue{FloatValue: v}}, nil
+	case string:
+		return &pb.Value{Kind: &pb.Value_StringValue{StringValue: v}}, nil
+	case bool:
+		return &pb.Value{Kind: &pb.Value_BoolValue{BoolValue: v}}, nil
+	case []byte:
+		return &pb.Value{Kind: &pb.Value_BytesValue{BytesValue: v}}, nil
+	case time.Time:
+		return &pb.Value{Kind: &pb.Value_TimestampValue{TimestampValue: v.UnixNano()}}, nil
+	case json.RawMessage:
+		return &pb.Value{Kind: &pb.Value_JsonValue{JsonValue: string(v)}}, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("client: encoding %T as json: %v", v, err)
+	}
+	if k := reflect.ValueOf(v).Kind(); k == reflect.Slice || k == reflect.Array {
+		// nil 切片编码为 null，不是合法的 list
+		if string(b) != "null" {
+			return &pb.Value{Kind: &pb.Value_ListValue{ListValue: string(b)}}, nil
+		}
+	}
+	return &pb.Value{Kind: &pb.Value_JsonValue{JsonValue: string(b)}}, nil
+}
+
+// FromValue converts a typed value to int64, float64, string, bool, []byte,
+// time.Time or, for lists and json, json.RawMessage.
+func FromValue(v *pb.Value) (interface{}, error) {
+	switch k := v.GetKind().(type) {
+	case *pb.Value_IntValue:
+		return k.IntValue, nil
+	case *pb.Value_FloatValue:
+		return k.FloatValue, nil
+	case *pb.Value_StringValue:
+		return k.StringValue, nil
+	case *pb.Value_BoolValue:
+		return k.BoolValue, nil
+	case *pb.Value_BytesValue:
+		return k.BytesValue, nil
+	case *pb.Value_TimestampValue:
+		return time.Unix(0, k.TimestampValue), nil
+	case *pb.Value_ListValue:
+		return json.RawMessage(k.ListValue), nil
+	case *pb.Value_JsonValue:
+		return json.RawMessage(k.JsonValue), nil
+	default:
+		return nil, fmt.Errorf("client: unsupported value %v", v)
+	}
+}
@@ -0,0 +1,92 @@
+package client
+
+import (
+	"context"
+	"fmt"
+
+	pb "github.com/Jille/raft-grpc-example/proto"
+)
+
+// WatchOptions describe what to watch.
+type WatchOptions struct {
+	// Prefix watches every key starting with the watched key.
+	Prefix bool
+	// StartRevision is the first revision to receive changes of; 0 watches
+	// from the next change.
+	StartRevision uint64
+	// Type is used to decode values.
+	Type Type
+}
+
+// Event is a change of one key. Deleted is set for deletes, in which case only
+// Key and ModRevision of KV are set.
+type Event struct {
+	KV       KeyValue
+	Deleted  bool
+	Revision uint64
+}
+
+// CompactedError is returned by Watcher.Recv when the requested revision is no
+// longer available on the server. Re-read the keys and watch again from
+// Revision+1.
+type CompactedError struct {
+	Revision uint64
+}
+
+func (e *CompactedError) Error() string {
+	return fmt.Sprintf("required revision has been compacted, compacted revision is %d", e.Revision)
+}
+
+// Watcher receives the changes of a watch in revision order.
+type Watcher struct {
+	stream pb.KV_WatchClient
+	cancel context.CancelFunc
+	t      Type
+}
+
+// Watch starts watching key. The watch ends when ctx is done or Close is
+// called. Unlike other calls it is not bound by the client timeout.
+func (c *Client) Watch(ctx context.Context, key string, opts WatchOptions) (*Watcher, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	stream, err := c.kv.Watch(ctx, &pb.WatchRequest{
+		Key:           []byte(key),
+		Prefix:        opts.Prefix,
+		StartRevision: opts.StartRevision,
+		Type:          string(opts.Type),
+	})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &Watcher{stream: stream, cancel: cancel, t: opts.Type}, nil
+}
+
+// Recv blocks until the next changes arrive. All events of a revision are
+// returned together.
+func (w *Watcher) Recv() ([]Event, error) {
+	resp, err := w.stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	if rev := resp.GetCompactRevision(); rev != 0 {
+		w.Close()
+		return nil, &CompactedError{Revision: rev}
+	}
+	events := make([]Event, 0, len(resp.GetEvents()))
+	for _, ev := range resp.GetEvents() {
+		e := Event{Revision: ev.GetRevision()}
+		if ev.GetType() == pb.Event_DELETE {
+			e.Deleted = true
+			e.KV = KeyValue{Key: string(ev.GetKv().GetKey()), ModRevision: ev.GetKv().GetModRevision()}
+		} else if e.KV, err = fromKeyValue(ev.GetKv()); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+// Close stops the watch.
+func (w *Watcher) Close() {
+	w.cancel()
+}
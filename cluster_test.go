@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	pb "github.com/Jille/raft-grpc-example/proto"
+	"github.com/Jille/raft-grpc-leader-rpc/leaderhealth"
+	"github.com/LaJunkai/drifterdb"
+	"github.com/hashicorp/raft"
+	"google.golang.org/grpc"
+)
+
+// 测试使用的进程内集群：每个节点有自己的 drifterdb 与状态机，
+// Raft 日志、快照与网络都在内存中。
+
+// testNode is a member of a testCluster.
+type testNode struct {
+	id    raft.ServerID
+	addr  raft.ServerAddress
+	fsm   *DrifterX
+	raft  *raft.Raft
+	logs  *raft.InmemStore
+	trans *raft.InmemTransport
+	dir   string
+	// grpc serves the KV service once the cluster is served, see serveGRPC.
+	grpc *grpc.Server
+}
+
+// testCluster is an in-process Raft cluster of DrifterX state machines.
+type testCluster struct {
+	t *testing.T
+	// config adjusts the Raft configuration of every node.
+	config func(*raft.Config)
+	nodes  []*testNode
+}
+
+// newTestCluster starts a cluster of n voters. Callers must shut it down.
+func newTestCluster(t *testing.T, n int, config func(*raft.Config)) *testCluster {
+	c := &testCluster{t: t, config: config}
+	var servers []raft.Server
+	for i := 0; i < n; i++ {
+		node := c.newNode()
+		servers = append(servers, raft.Server{ID: node.id, Address: node.addr})
+	}
+	for _, node := range c.nodes {
+		if err := node.raft.BootstrapCluster(raft.Configuration{Servers: servers}).Error(); err != nil {
+			t.Fatalf("bootstrapping %s: %v", node.id, err)
+		}
+	}
+	return c
+}
+
+// newNode starts a node that is not part of the configuration yet.
+func (c *testCluster) newNode() *testNode {
+	dir, err := ioutil.TempDir("", "drifterx-test")
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	addr, trans := raft.NewInmemTransport("")
+	for _, other := range c.nodes {
+		trans.Connect(other.addr, other.trans)
+		other.trans.Connect(addr, trans)
+	}
+	node := &testNode{
+		id:    raft.ServerID(fmt.Sprintf("node%d", len(c.nodes))),
+		addr:  addr,
+		fsm:   NewDrifterX(drifterdb.OpenDB(dir)),
+		logs:  raft.NewInmemStore(),
+		trans: trans,
+		dir:   dir,
+	}
+	conf := raft.DefaultConfig()
+	conf.LocalID = node.id
+	conf.HeartbeatTimeout = 50 * time.Millisecond
+	conf.ElectionTimeout = 50 * time.Millisecond
+	conf.LeaderLeaseTimeout = 50 * time.Millisecond
+	conf.CommitTimeout = 5 * time.Millisecond
+	conf.LogOutput = ioutil.Discard
+	if c.config != nil {
+		c.config(conf)
+	}
+	node.raft, err = raft.NewRaft(conf, node.fsm, node.logs, raft.NewInmemStore(), raft.NewInmemSnapshotStore(), trans)
+	if err != nil {
+		c.t.Fatalf("raft.NewRaft: %v", err)
+	}
+	c.nodes = append(c.nodes, node)
+	return node
+}
+
+// addNode starts a node and adds it to the configuration as a voter.
+func (c *testCluster) addNode() *testNode {
+	node := c.newNode()
+	if err := c.leader().raft.AddVoter(node.id, node.addr, 0, 0).Error(); err != nil {
+		c.t.Fatalf("adding %s: %v", node.id, err)
+	}
+	return node
+}
+
+// leader waits for a node to become leader and returns it.
+func (c *testCluster) leader() *testNode {
+	var leader *testNode
+	c.waitFor("a leader", func() bool {
+		for _, node := range c.nodes {
+			if node.raft.State() == raft.Leader {
+				leader = node
+				return true
+			}
+		}
+		return false
+	})
+	return leader
+}
+
+// apply applies cmd through the leader.
+func (c *testCluster) apply(cmd *Command) (interface{}, error) {
+	_, res, err := applyCommand(context.Background(), c.leader().raft, cmd)
+	return res, err
+}
+
+// serveGRPC serves the KV service of every node on a local port, like main
+// does, and returns their addresses. The leader also expires leases and keys.
+func (c *testCluster) serveGRPC() []string {
+	var addrs []string
+	for _, node := range c.nodes {
+		sock, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			c.t.Fatalf("listen: %v", err)
+		}
+		node.grpc = grpc.NewServer(
+			grpc.UnaryInterceptor(errorUnaryInterceptor(node.raft)),
+			grpc.StreamInterceptor(errorStreamInterceptor(node.raft)),
+		)
+		pb.RegisterKVServer(node.grpc, &rpcInterface{drifterX: node.fsm, raft: node.raft})
+		leaderhealth.Setup(node.raft, node.grpc, []string{"drifterx.KV"})
+		go node.grpc.Serve(sock)
+		go RunExpiry(node.raft, node.fsm)
+		addrs = append(addrs, sock.Addr().String())
+	}
+	return addrs
+}
+
+// waitFor fails the test unless cond holds within a few seconds.
+func (c *testCluster) waitFor(what string, cond func() bool) {
+	c.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			c.t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (c *testCluster) shutdown() {
+	for _, node := range c.nodes {
+		if node.grpc != nil {
+			node.grpc.Stop()
+		}
+		if err := node.raft.Shutdown().Error(); err != nil {
+			c.t.Errorf("shutting down %s: %v", node.id, err)
+		}
+		node.trans.Close()
+		os.RemoveAll(node.dir)
+	}
+}
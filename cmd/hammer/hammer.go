@@ -1,11 +1,12 @@
 // Binary hammer sends requests to your Raft cluster as fast as it can.
-// It sends the written out version of the Dutch numbers up to 2000.
-// In the end it asks the Raft cluster what the longest three words were.
+// It stores the written out version of the Dutch numbers up to 2000, keyed by
+// the word and valued by the number. In the end it reads all of them back.
 package main
 
 import (
 	"context"
 	"fmt"
+	"io"
 	"log"
 	"sync"
 	"time"
@@ -19,7 +20,7 @@ import (
 )
 
 func main() {
-	serviceConfig := `{"healthCheckConfig": {"serviceName": "Example"}, "loadBalancingConfig": [ { "round_robin": {} } ]}`
+	serviceConfig := `{"healthCheckConfig": {"serviceName": "drifterx.KV"}, "loadBalancingConfig": [ { "round_robin": {} } ]}`
 	retryOpts := []grpc_retry.CallOption{
 		grpc_retry.WithBackoff(grpc_retry.BackoffExponential(100 * time.Millisecond)),
 		grpc_retry.WithMax(5),
@@ -32,7 +33,7 @@ func main() {
 		log.Fatalf("dialing failed: %v", err)
 	}
 	defer conn.Close()
-	c := pb.NewExampleClient(conn)
+	c := pb.NewKVClient(conn)
 
 	ch := generateWords()
 
@@ -42,26 +43,45 @@ func main() {
 		go func() {
 			defer wg.Done()
 			for w := range ch {
-				_, err := c.AddWord(context.Background(), &pb.AddWordRequest{Word: w})
+				_, err := c.Put(context.Background(), &pb.PutRequest{
+					Key:   []byte(w.word),
+					Value: &pb.Value{Kind: &pb.Value_IntValue{IntValue: int64(w.number)}},
+				})
 				if err != nil {
-					log.Fatalf("AddWord RPC failed: %v", err)
+					log.Fatalf("Put RPC failed: %v", err)
 				}
 			}
 		}()
 	}
 	wg.Wait()
-	resp, err := c.GetWords(context.Background(), &pb.GetWordsRequest{})
+	stream, err := c.RangeStream(context.Background(), &pb.RangeRequest{Type: "int"})
 	if err != nil {
-		log.Fatalf("GetWords RPC failed: %v", err)
+		log.Fatalf("RangeStream RPC failed: %v", err)
 	}
-	fmt.Println(resp)
+	words := 0
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatalf("RangeStream RPC failed: %v", err)
+		}
+		words += len(resp.GetKvs())
+	}
+	fmt.Printf("read %d words\n", words)
+}
+
+type numberWord struct {
+	number int
+	word   string
 }
 
-func generateWords() <-chan string {
-	ch := make(chan string, 1)
+func generateWords() <-chan numberWord {
+	ch := make(chan numberWord, 1)
 	go func() {
 		for i := 1; 2000 > i; i++ {
-			ch <- ntw.IntegerToNlNl(i)
+			ch <- numberWord{number: i, word: ntw.IntegerToNlNl(i)}
 		}
 		close(ch)
 	}()
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Raft 日志中命令的编码格式。
+//
+// 早期版本直接使用 encoding/json 序列化 Command，这类日志总是以 '{' 开头，
+// 仍然可以被解码，保证已有的 logs.dat 能够正常重放。新写入的日志以格式版本字节开头，
+// 其后是若干字段，每个字段为 uvarint(tag) | uvarint(len) | payload。
+// 解码时会跳过未知的 tag，便于以后增加字段。
+const (
+	commandFormatV1 byte = 0x01
+)
+
+const (
+	fieldOpType = iota + 1
+	fieldKey
+	fieldValue
+	fieldTrxID
+	fieldOp
+	fieldTime
+	fieldTTL
+	fieldCond
+	fieldCondValue
+	fieldCondVersion
+	fieldCondRevision
+	fieldRevision
+	fieldLeaseID
+	fieldDelta
+	fieldInitial
+	fieldMin
+	fieldMax
+	fieldValueType
+	fieldPath
+)
+
+var errEmptyCommand = errors.New("empty command")
+
+// encodeCommand serializes c using the current binary format.
+func encodeCommand(c *Command) []byte {
+	buf := make([]byte, 0, 16+len(c.Key)+len(c.Value))
+	buf = append(buf, commandFormatV1)
+	buf = appendUintField(buf, fieldOpType, uint64(c.OpType))
+	if len(c.Key) > 0 {
+		buf = appendField(buf, fieldKey, c.Key)
+	}
+	if len(c.Value) > 0 {
+		buf = appendField(buf, fieldValue, c.Value)
+	}
+	if c.TrxID != 0 {
+		buf = appendUintField(buf, fieldTrxID, c.TrxID)
+	}
+	for _, op := range c.Ops {
+		buf = appendField(buf, fieldOp, encodeCommand(op))
+	}
+	if c.Time != 0 {
+		buf = appendUintField(buf, fieldTime, uint64(c.Time))
+	}
+	if c.TTL != 0 {
+		buf = appendUintField(buf, fieldTTL, uint64(c.TTL))
+	}
+	if c.Cond != CondNone {
+		buf = appendUintField(buf, fieldCond, uint64(c.Cond))
+	}
+	// nil 与空值含义不同（OpCAS 中 nil 表示期望 key 不存在），空值也需要写入
+	if c.CondValue != nil {
+		buf = appendField(buf, fieldCondValue, c.CondValue)
+	}
+	if c.CondVersion != 0 {
+		buf = appendUintField(buf, fieldCondVersion, c.CondVersion)
+	}
+	if c.CondRevision != 0 {
+		buf = appendUintField(buf, fieldCondRevision, c.CondRevision)
+	}
+	if c.Revision != 0 {
+		buf = appendUintField(buf, fieldRevision, c.Revision)
+	}
+	if c.LeaseID != 0 {
+		buf = appendUintField(buf, fieldLeaseID, c.LeaseID)
+	}
+	// 有符号整数按补码写入
+	if c.Delta != 0 {
+		buf = appendUintField(buf, fieldDelta, uint64(c.Delta))
+	}
+	if c.Initial != 0 {
+		buf = appendUintField(buf, fieldInitial, uint64(c.Initial))
+	}
+	if c.Min != nil {
+		buf = appendUintField(buf, fieldMin, uint64(*c.Min))
+	}
+	if c.Max != nil {
+		buf = appendUintField(buf, fieldMax, uint64(*c.Max))
+	}
+	if c.ValueType != "" {
+		buf = appendField(buf, fieldValueType, []byte(c.ValueType))
+	}
+	if c.Path != "" {
+		buf = appendField(buf, fieldPath, []byte(c.Path))
+	}
+	return buf
+}
+
+// decodeCommand parses a command in either the binary or the legacy JSON format.
+func decodeCommand(b []byte) (*Command, error) {
+	if len(b) == 0 {
+		return nil, errEmptyCommand
+	}
+	switch b[0] {
+	case '{':
+		c := &Command{}
+		if err := json.Unmarshal(b, c); err != nil {
+			return nil, fmt.Errorf("unable to parse json command: %v", err)
+		}
+		markLegacy(c)
+		return c, nil
+	case commandFormatV1:
+		return decodeCommandV1(b[1:])
+	default:
+		return nil, fmt.Errorf("unknown command format 0x%02x", b[0])
+	}
+}
+
+func decodeCommandV1(b []byte) (*Command, error) {
+	c := &Command{}
+	for len(b) > 0 {
+		tag, payload, rest, err := nextField(b)
+		if err != nil {
+			return nil, err
+		}
+		b = rest
+		switch tag {
+		case fieldOpType:
+			v, err := uintPayload(payload)
+			if err != nil {
+				return nil, err
+			}
+			c.OpType = int(v)
+		case fieldKey:
+			c.Key = payload
+		case fieldValue:
+			c.Value = payload
+		case fieldTrxID:
+			v, err := uintPayload(payload)
+			if err != nil {
+				return nil, err
+			}
+			c.TrxID = v
+		case fieldOp:
+			op, err := decodeCommand(payload)
+			if err != nil {
+				return nil, fmt.Errorf("decoding batch operation: %v", err)
+			}
+			c.Ops = append(c.Ops, op)
+		case fieldTime:
+			v, err := uintPayload(payload)
+			if err != nil {
+				return nil, err
+			}
+			c.Time = int64(v)
+		case fieldTTL:
+			v, err := uintPayload(payload)
+			if err != nil {
+				return nil, err
+			}
+			c.TTL = int64(v)
+		case fieldCond:
+			v, err := uintPayload(payload)
+			if err != nil {
+				return nil, err
+			}
+			c.Cond = int(v)
+		case fieldCondValue:
+			c.CondValue = payload
+		case fieldCondVersion:
+			v, err := uintPayload(payload)
+			if err != nil {
+				return nil, err
+			}
+			c.CondVersion = v
+		case fieldCondRevision:
+			v, err := uintPayload(payload)
+			if err != nil {
+				return nil, err
+			}
+			c.CondRevision = v
+		case fieldRevision:
+			v, err := uintPayload(payload)
+			if err != nil {
+				return nil, err
+			}
+			c.Revision = v
+		case fieldLeaseID:
+			v, err := uintPayload(payload)
+			if err != nil {
+				return nil, err
+			}
+			c.LeaseID = v
+		case fieldDelta, fieldInitial, fieldMin, fieldMax:
+			u, err := uintPayload(payload)
+			if err != nil {
+				return nil, err
+			}
+			v := int64(u)
+			switch tag {
+			case fieldDelta:
+				c.Delta = v
+			case fieldInitial:
+				c.Initial = v
+			case fieldMin:
+				c.Min = &v
+			case fieldMax:
+				c.Max = &v
+			}
+		case fieldValueType:
+			c.ValueType = string(payload)
+		case fieldPath:
+			c.Path = string(payload)
+		}
+	}
+	return c, nil
+}
+
+func markLegacy(c *Command) {
+	c.legacy = true
+	for _, op := range c.Ops {
+		markLegacy(op)
+	}
+}
+
+func appendField(buf []byte, tag uint64, payload []byte) []byte {
+	buf = appendUvarint(buf, tag)
+	buf = appendUvarint(buf, uint64(len(payload)))
+	return append(buf, payload...)
+}
+
+func appendUintField(buf []byte, tag uint64, v uint64) []byte {
+	return appendField(buf, tag, appendUvarint(nil, v))
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	tmp := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(tmp, v)
+	return append(buf, tmp[:n]...)
+}
+
+// nextField splits the first field off b.
+func nextField(b []byte) (tag uint64, payload []byte, rest []byte, err error) {
+	tag, n := binary.Uvarint(b)
+	if n <= 0 {
+		return 0, nil, nil, errors.New("malformed command: bad field tag")
+	}
+	b = b[n:]
+	l, n := binary.Uvarint(b)
+	if n <= 0 || l > uint64(len(b)-n) {
+		return 0, nil, nil, fmt.Errorf("malformed command: bad length for field %d", tag)
+	}
+	b = b[n:]
+	return tag, b[:l], b[l:], nil
+}
+
+func uintPayload(payload []byte) (uint64, error) {
+	v, n := binary.Uvarint(payload)
+	if n <= 0 || n != len(payload) {
+		return 0, errors.New("malformed command: bad integer field")
+	}
+	return v, nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// 条件写入。条件在 DrifterX.Apply 中检查，检查与写入在每个副本上都是原子的。
+const (
+	CondNone = iota
+	// CondIfAbsent 要求 key 不存在
+	CondIfAbsent
+	// CondIfValueEquals 要求 key 存在且当前值等于 CondValue
+	CondIfValueEquals
+	// CondIfVersionEquals 要求 key 的版本等于 CondVersion，0 表示 key 不存在
+	CondIfVersionEquals
+	// CondIfModRevisionEquals 要求 key 的 mod revision 等于 CondRevision，0 表示 key 不存在
+	CondIfModRevisionEquals
+)
+
+var errPreconditionFailed = errors.New("precondition failed")
+
+// checkCondition evaluates the precondition of c against the current entry of
+// its key. OpCAS commands compare against CondValue, where a nil CondValue
+// expects the key to be absent.
+func checkCondition(current *entry, c *Command) error {
+	ok := true
+	switch {
+	case c.OpType == OpCAS:
+		if c.CondValue == nil {
+			ok = current == nil
+		} else {
+			ok = current != nil && bytes.Equal(current.Value, c.CondValue)
+		}
+	case c.Cond == CondNone:
+	case c.Cond == CondIfAbsent:
+		ok = current == nil
+	case c.Cond == CondIfValueEquals:
+		ok = current != nil && bytes.Equal(current.Value, c.CondValue)
+	case c.Cond == CondIfVersionEquals:
+		var version uint64
+		if current != nil {
+			version = current.Version
+		}
+		ok = version == c.CondVersion
+	case c.Cond == CondIfModRevisionEquals:
+		var rev uint64
+		if current != nil {
+			rev = current.ModRevision
+		}
+		ok = rev == c.CondRevision
+	default:
+		return fmt.Errorf("unsupported condition %d", c.Cond)
+	}
+	if !ok {
+		return errPreconditionFailed
+	}
+	return nil
+}
+
+// applyWrite checks the precondition of a put, delete or CAS command and
+// performs it on w.
+//
+// 已过期但尚未被删除的 key 视为不存在，过期以命令中 leader 的时间为准。
+func applyWrite(w kvWriter, c *Command) error {
+	current, err := getLiveEntry(w, c.Key, c.Time)
+	if err != nil {
+		return err
+	}
+	if err := checkCondition(current, c); err != nil {
+		return err
+	}
+	return writeEntry(w, current, c)
+}
+
+// writeEntry performs a put, delete or CAS command on w without checking its
+// precondition. Increments and JSON document commands compute their value
+// themselves and store it with writeUpdatedEntry. current is the live entry currently
+// stored under the key and c.Revision the log index the write is recorded at.
+// A put with a TTL expires c.TTL after c.Time; a put without one clears any
+// previous expiry. Likewise a put attaches the key to c.LeaseID, detaching it
+// from any previous lease.
+func writeEntry(w kvWriter, current *entry, c *Command) error {
+	if c.OpType != OpDel {
+		if err := checkKey(c.Key); err != nil {
+			return err
+		}
+	}
+	switch c.OpType {
+	case OpPut, OpCAS:
+		e := &entry{Value: c.Value, Version: 1, CreateRevision: c.Revision, ModRevision: c.Revision, Lease: c.LeaseID, Type: c.ValueType}
+		if c.TTL > 0 {
+			e.ExpiresAt = c.Time + c.TTL
+		}
+		if current != nil {
+			e.Version = current.Version + 1
+			e.CreateRevision = current.CreateRevision
+		}
+		return w.Put(c.Key, encodeEntry(e))
+	case OpDel:
+		return w.Delete(c.Key)
+	default:
+		return fmt.Errorf("operation type %d is not a write", c.OpType)
+	}
+}
+
+// writeUpdatedEntry stores value of type t, computed by command c from the
+// current entry of its key.
+func writeUpdatedEntry(w kvWriter, current *entry, c *Command, value []byte, t string) error {
+	if err := checkKey(c.Key); err != nil {
+		return err
+	}
+	// 只修改值，保留 key 原有的过期时间与租约
+	e := &entry{Value: value, Version: 1, CreateRevision: c.Revision, ModRevision: c.Revision, Type: t}
+	if current != nil {
+		e.Version = current.Version + 1
+		e.CreateRevision = current.CreateRevision
+		e.ExpiresAt = current.ExpiresAt
+		e.Lease = current.Lease
+	}
+	return w.Put(c.Key, encodeEntry(e))
+}
+
+// applyUpdateCommand applies a command that modifies the current value of its
+// key at index, either directly or inside the transaction it names. apply
+// performs the command on w and returns its result.
+func (x *DrifterX) applyUpdateCommand(index uint64, c *Command, apply func(w kvWriter) (interface{}, error)) interface{} {
+	var res interface{}
+	if c.TrxID == 0 {
+		err := x.publishChanges(index, [][]byte{c.Key}, func() error {
+			var err error
+			res, err = apply(x.db)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		return res
+	}
+	trx := x.transaction(c.TrxID)
+	if trx == nil {
+		return errTrxNotFound
+	}
+	res, err := apply(trx)
+	if err != nil {
+		return err
+	}
+	x.recordTransactionOps(c.TrxID, c)
+	return res
+}
+
+// setPreconditions copies the preconditions of an HTTP request into cmd.
+// IfValueEquals is converted with the same type as the value, or the type
+// inferred from it if valueType is empty.
+func setPreconditions(cmd *Command, p Preconditions, valueType string) error {
+	set := 0
+	if p.IfAbsent {
+		cmd.Cond = CondIfAbsent
+		set++
+	}
+	if p.IfValueEquals != nil {
+		if valueType == "" {
+			valueType = inferType(p.IfValueEquals)
+		}
+		expected, err := ConvertToBytes(valueType, p.IfValueEquals)
+		if err != nil {
+			return fmt.Errorf("if_value_equals: %v", err)
+		}
+		cmd.Cond = CondIfValueEquals
+		cmd.CondValue = expected
+		set++
+	}
+	if p.IfVersionEquals != nil {
+		cmd.Cond = CondIfVersionEquals
+		cmd.CondVersion = *p.IfVersionEquals
+		set++
+	}
+	if p.IfModRevisionEquals != nil {
+		cmd.Cond = CondIfModRevisionEquals
+		cmd.CondRevision = *p.IfModRevisionEquals
+		set++
+	}
+	if set > 1 {
+		return errors.New("only one of if_absent, if_value_equals, if_version_equals and if_mod_revision_equals may be set")
+	}
+	return nil
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"gopkg.in/yaml.v2"
+)
+
+// 节点配置的来源，后者覆盖前者：默认值、--config 指定的 YAML 文件、
+// DRIFTERX_ 开头的环境变量、命令行上显式给出的参数。
+
+// envPrefix prefixes the environment variables that override the config. The
+// variable of a setting is its YAML path in upper case joined by _, e.g.
+// DRIFTERX_RAFT_ELECTION_TIMEOUT for raft.election_timeout.
+const envPrefix = "DRIFTERX"
+
+// Config is the configuration of a node.
+type Config struct {
+	// NodeID is the Raft server ID of the node.
+	NodeID string `yaml:"node_id"`
+	// Bootstrap bootstraps a new cluster with this node as its only voter.
+	Bootstrap bool `yaml:"bootstrap"`
+	// ForwardMode is what a follower does with write requests, see
+	// ForwardModeForward.
+	ForwardMode string `yaml:"forward_mode"`
+
+	GRPC AddressConfig `yaml:"grpc"`
+	HTTP AddressConfig `yaml:"http"`
+	Raft RaftConfig    `yaml:"raft"`
+	DB   DBConfig      `yaml:"db"`
+	TLS  TLSConfig     `yaml:"tls"`
+}
+
+// AddressConfig is the address a server listens on and the address other
+// nodes and clients reach it at.
+type AddressConfig struct {
+	Listen    string `yaml:"listen"`
+	Advertise string `yaml:"advertise"`
+}
+
+// RaftConfig configures the Raft log, its transport and snapshots. Without a
+// listen address the transport is served by the gRPC server and advertised at
+// the gRPC address.
+type RaftConfig struct {
+	AddressConfig `yaml:",inline"`
+	// DataDir holds the log, stable store and snapshots of every node in a
+	// directory named by its ID.
+	DataDir string `yaml:"data_dir"`
+
+	HeartbeatTimeout   time.Duration `yaml:"heartbeat_timeout"`
+	ElectionTimeout    time.Duration `yaml:"election_timeout"`
+	CommitTimeout      time.Duration `yaml:"commit_timeout"`
+	LeaderLeaseTimeout time.Duration `yaml:"leader_lease_timeout"`
+
+	// SnapshotInterval is how often Raft checks whether to take a snapshot,
+	// SnapshotThreshold how many new log entries it takes.
+	SnapshotInterval  time.Duration `yaml:"snapshot_interval"`
+	SnapshotThreshold uint64        `yaml:"snapshot_threshold"`
+	// TrailingLogs is the number of log entries kept after a snapshot.
+	TrailingLogs uint64 `yaml:"trailing_logs"`
+	// SnapshotRetain is the number of snapshots kept on disk.
+	SnapshotRetain int `yaml:"snapshot_retain"`
+}
+
+// DBConfig configures drifterdb.
+type DBConfig struct {
+	// DataDir holds the database of every node in a directory named by its ID.
+	DataDir string `yaml:"data_dir"`
+}
+
+// TLSConfig enables TLS on the gRPC and HTTP servers and between the nodes
+// when CertFile and KeyFile are set. With CAFile, peers and clients must
+// present a certificate signed by that CA.
+type TLSConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	CAFile   string `yaml:"ca_file"`
+}
+
+// DefaultConfig returns the configuration of a node without config file,
+// environment or flags.
+func DefaultConfig() *Config {
+	rc := raft.DefaultConfig()
+	return &Config{
+		NodeID:      "nodeA",
+		ForwardMode: ForwardModeRedirect,
+		GRPC:        AddressConfig{Listen: ":51127", Advertise: "localhost:51127"},
+		HTTP:        AddressConfig{Listen: ":1127", Advertise: "localhost:1127"},
+		Raft: RaftConfig{
+			DataDir:            "cluster",
+			HeartbeatTimeout:   rc.HeartbeatTimeout,
+			ElectionTimeout:    rc.ElectionTimeout,
+			CommitTimeout:      rc.CommitTimeout,
+			LeaderLeaseTimeout: rc.LeaderLeaseTimeout,
+			SnapshotInterval:   rc.SnapshotInterval,
+			SnapshotThreshold:  rc.SnapshotThreshold,
+			TrailingLogs:       rc.TrailingLogs,
+			SnapshotRetain:     3,
+		},
+		DB: DBConfig{DataDir: "db"},
+	}
+}
+
+// LoadConfig reads the YAML config file at path on top of the defaults, or
+// only the defaults if path is empty, and applies the environment overrides.
+// Unknown settings are an error.
+func LoadConfig(path string) (*Config, error) {
+	cfg := DefaultConfig()
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.UnmarshalStrict(b, cfg); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	if err := applyEnv(reflect.ValueOf(cfg).Elem(), envPrefix); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// applyEnv sets the fields of the struct v from the environment variables
+// named prefix_FIELD.
+func applyEnv(v reflect.Value, prefix string) error {
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		tag := strings.Split(f.Tag.Get("yaml"), ",")
+		name := prefix
+		if tag[0] != "" {
+			name += "_" + strings.ToUpper(tag[0])
+		} else if len(tag) < 2 || tag[1] != "inline" {
+			continue
+		}
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			if err := applyEnv(field, name); err != nil {
+				return err
+			}
+			continue
+		}
+		s, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setField(field, s); err != nil {
+			return fmt.Errorf("environment variable %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func setField(v reflect.Value, s string) error {
+	if v.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int:
+		i, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(i))
+	case reflect.Uint64:
+		u, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetUint(u)
+	default:
+		return fmt.Errorf("unsupported setting of kind %v", v.Kind())
+	}
+	return nil
+}
+
+// Validate checks the configuration and reports every problem it finds.
+func (cfg *Config) Validate() error {
+	var problems []string
+	check := func(err error, setting string) {
+		if err != nil {
+			problems = append(problems, setting+": "+err.Error())
+		}
+	}
+	if cfg.NodeID == "" {
+		problems = append(problems, "node_id is required")
+	}
+	switch cfg.ForwardMode {
+	case ForwardModeForward, ForwardModeRedirect, ForwardModeReject:
+	default:
+		problems = append(problems, fmt.Sprintf("forward_mode: unsupported forward mode [%v]", cfg.ForwardMode))
+	}
+	check(checkListen(cfg.GRPC.Listen, false), "grpc.listen")
+	check(checkAdvertise(cfg.GRPC.Advertise), "grpc.advertise")
+	check(checkListen(cfg.HTTP.Listen, false), "http.listen")
+	check(checkAdvertise(cfg.HTTP.Advertise), "http.advertise")
+	check(checkListen(cfg.Raft.Listen, true), "raft.listen")
+	if cfg.Raft.Listen != "" || cfg.Raft.Advertise != "" {
+		check(checkAdvertise(cfg.Raft.Advertise), "raft.advertise")
+	}
+	if cfg.Raft.Listen == "" && cfg.Raft.Advertise != "" && cfg.Raft.Advertise != cfg.GRPC.Advertise {
+		problems = append(problems, "raft.advertise must equal grpc.advertise unless raft.listen is set")
+	}
+	// 未单独监听且未要求客户端证书时，Forwarder 服务与 KV 服务一样对外开放，
+	// 任何客户端都能借它以 leader 的身份执行写请求或改写节点地址
+	if cfg.ForwardMode == ForwardModeForward && cfg.Raft.Listen == "" && !cfg.TLS.Mutual() {
+		problems = append(problems, "forward_mode: forward requires raft.listen or tls with ca_file, otherwise the Forwarder service is exposed unauthenticated on grpc.listen")
+	}
+	if cfg.Raft.Listen != "" && cfg.Raft.Listen == cfg.GRPC.Listen {
+		problems = append(problems, "raft.listen must differ from grpc.listen, leave it empty to share the gRPC server")
+	}
+	if cfg.Raft.DataDir == "" {
+		problems = append(problems, "raft.data_dir is required")
+	}
+	if cfg.DB.DataDir == "" {
+		problems = append(problems, "db.data_dir is required")
+	}
+	if cfg.Raft.SnapshotRetain < 1 {
+		problems = append(problems, "raft.snapshot_retain must be at least 1")
+	}
+	check(raft.ValidateConfig(cfg.raftConfig()), "raft")
+	t := cfg.TLS
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		problems = append(problems, "tls.cert_file and tls.key_file must be set together")
+	}
+	if t.CAFile != "" && t.CertFile == "" {
+		problems = append(problems, "tls.ca_file requires tls.cert_file and tls.key_file")
+	}
+	if len(problems) > 0 {
+		return errors.New("invalid config:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+func checkListen(addr string, optional bool) error {
+	if addr == "" && optional {
+		return nil
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err == nil && port == "" {
+		err = errors.New("port is required")
+	}
+	return err
+}
+
+// checkAdvertise checks that addr is an address other machines can dial.
+func checkAdvertise(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	switch {
+	case err != nil:
+		return err
+	case port == "" || port == "0":
+		return errors.New("port is required")
+	case host == "":
+		return errors.New("host is required")
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		return fmt.Errorf("unspecified address %v cannot be dialed", host)
+	}
+	return nil
+}
+
+// RaftAdvertise returns the address the other nodes reach the Raft transport
+// at. It is also the address they forward requests to.
+func (cfg *Config) RaftAdvertise() string {
+	if cfg.Raft.Listen == "" {
+		return cfg.GRPC.Advertise
+	}
+	return cfg.Raft.Advertise
+}
+
+// raftConfig returns the Raft configuration of the node.
+func (cfg *Config) raftConfig() *raft.Config {
+	c := raft.DefaultConfig()
+	c.LocalID = raft.ServerID(cfg.NodeID)
+	c.HeartbeatTimeout = cfg.Raft.HeartbeatTimeout
+	c.ElectionTimeout = cfg.Raft.ElectionTimeout
+	c.CommitTimeout = cfg.Raft.CommitTimeout
+	c.LeaderLeaseTimeout = cfg.Raft.LeaderLeaseTimeout
+	c.SnapshotInterval = cfg.Raft.SnapshotInterval
+	c.SnapshotThreshold = cfg.Raft.SnapshotThreshold
+	c.TrailingLogs = cfg.Raft.TrailingLogs
+	return c
+}
+
+// Enabled reports whether TLS is configured.
+func (t TLSConfig) Enabled() bool {
+	return t.CertFile != ""
+}
+
+// Mutual reports whether peers and clients must present a certificate signed
+// by the configured CA.
+func (t TLSConfig) Mutual() bool {
+	return t.Enabled() && t.CAFile != ""
+}
+
+// tlsConfigs returns the TLS configurations of the servers and of the
+// connections to other nodes.
+func (t TLSConfig) tlsConfigs() (*tls.Config, *tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("tls: %v", err)
+	}
+	server := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	client := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if t.CAFile != "" {
+		pem, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("tls: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("tls: no certificate found in %s", t.CAFile)
+		}
+		server.ClientCAs = pool
+		server.ClientAuth = tls.RequireAndVerifyClientCert
+		client.RootCAs = pool
+	}
+	return server, client, nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+)
+
+// TestValidateForwardMode checks that forwarding is only accepted when the
+// Forwarder service is not reachable by unauthenticated clients.
+func TestValidateForwardMode(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		raft  string
+		tls   TLSConfig
+		valid bool
+	}{
+		{"shared server", "", TLSConfig{}, false},
+		{"server-only tls", "", TLSConfig{CertFile: "cert.pem", KeyFile: "key.pem"}, false},
+		{"mutual tls", "", TLSConfig{CertFile: "cert.pem", KeyFile: "key.pem", CAFile: "ca.pem"}, true},
+		{"raft.listen", ":50051", TLSConfig{}, true},
+	} {
+		cfg := DefaultConfig()
+		cfg.ForwardMode = ForwardModeForward
+		cfg.TLS = tc.tls
+		if tc.raft != "" {
+			cfg.Raft.Listen = tc.raft
+			cfg.Raft.Advertise = "localhost" + tc.raft
+		}
+		err := cfg.Validate()
+		if got := err == nil; got != tc.valid {
+			t.Errorf("%s: Validate() = %v, want valid %v", tc.name, err, tc.valid)
+		}
+	}
+}
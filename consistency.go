@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/hashicorp/raft"
+)
+
+// 读请求支持的一致性级别
+const (
+	// ReadStale 直接读取本地数据，任何节点都可以响应，可能读到旧值
+	ReadStale = "stale"
+	// ReadLeader 只允许 leader 响应，但不确认其 leader 身份是否仍然有效
+	ReadLeader = "leader"
+	// ReadLinearizable 在读取前确认 leader 身份并等待本地状态机追上，保证读到最新的已提交数据
+	ReadLinearizable = "linearizable"
+)
+
+// DefaultReadConsistency is used when a read request does not specify one.
+const DefaultReadConsistency = ReadLinearizable
+
+var errNotLeader = errors.New("requested node is not leader")
+
+// setApplied records that the FSM applied the entry at index.
+func (x *DrifterX) setApplied(index uint64) {
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	x.applied = index
+}
+
+// appliedIndex returns the index of the last command the FSM applied. Unlike
+// raft.Raft.AppliedIndex, which advances as soon as an entry is handed to the
+// FSM, the state a read observes includes this entry.
+func (x *DrifterX) appliedIndex() uint64 {
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	return x.applied
+}
+
+// waitForRead blocks until this node may serve a read at the requested
+// consistency level and returns the applied index the read will observe.
+//
+// Linearizable reads confirm with a quorum that this node is still the
+// leader and then wait for a barrier: Raft only resolves it once the FSM
+// applied every entry before it, so the read sees every write acknowledged
+// before it started. The wait ends with the deadline of ctx, or rpcTimeout if
+// it has none, and when ctx is cancelled.
+func (x *DrifterX) waitForRead(ctx context.Context, r *raft.Raft, consistency string) (uint64, error) {
+	switch consistency {
+	case "":
+		consistency = DefaultReadConsistency
+	case ReadStale, ReadLeader, ReadLinearizable:
+	default:
+		return 0, newAPIError(CodeInvalidArgument, fmt.Sprintf("unsupported consistency [%v]", consistency))
+	}
+	if consistency == ReadStale {
+		return x.appliedIndex(), nil
+	}
+	if r.State() != raft.Leader {
+		return 0, errNotLeader
+	}
+	if consistency == ReadLeader {
+		return x.appliedIndex(), nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout(ctx))
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		err := r.VerifyLeader().Error()
+		if err == nil {
+			err = r.Barrier(timeout(ctx)).Error()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return 0, leadershipError(err)
+		}
+		return x.appliedIndex(), nil
+	case <-ctx.Done():
+		// 请求被取消或超时后不再等待
+		return 0, newAPIError(CodeTimeout, fmt.Sprintf("timed out waiting for the log to be applied (applied %d)", x.appliedIndex()))
+	}
+}
+
+// leadershipError reports a leader-only raft future that failed because this
+// node is not (anymore) the leader as errNotLeader.
+func leadershipError(err error) error {
+	if err == raft.ErrNotLeader || err == raft.ErrLeadershipLost {
+		return errNotLeader
+	}
+	return err
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/LaJunkai/drifterdb"
+	"github.com/hashicorp/raft"
+)
+
+// gatedFSM holds every Apply until the gate is opened, so the FSM falls
+// behind the entries Raft already handed to it.
+type gatedFSM struct {
+	*DrifterX
+	gate chan struct{}
+}
+
+func (f *gatedFSM) Apply(l *raft.Log) interface{} {
+	<-f.gate
+	return f.DrifterX.Apply(l)
+}
+
+// TestLinearizableReadWaitsForFSM checks that a linearizable read waits until
+// the FSM applied a write that Raft already committed and handed to it, unless
+// its request is cancelled.
+func TestLinearizableReadWaitsForFSM(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drifterx-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	x := NewDrifterX(drifterdb.OpenDB(dir))
+	fsm := &gatedFSM{DrifterX: x, gate: make(chan struct{})}
+	opened := false
+	defer func() {
+		if !opened {
+			close(fsm.gate)
+		}
+	}()
+
+	conf := raft.DefaultConfig()
+	conf.LocalID = "node0"
+	conf.HeartbeatTimeout = 50 * time.Millisecond
+	conf.ElectionTimeout = 50 * time.Millisecond
+	conf.LeaderLeaseTimeout = 50 * time.Millisecond
+	conf.CommitTimeout = 5 * time.Millisecond
+	conf.LogOutput = ioutil.Discard
+	addr, trans := raft.NewInmemTransport("")
+	r, err := raft.NewRaft(conf, fsm, raft.NewInmemStore(), raft.NewInmemStore(), raft.NewInmemSnapshotStore(), trans)
+	if err != nil {
+		t.Fatalf("raft.NewRaft: %v", err)
+	}
+	defer r.Shutdown()
+	if err := r.BootstrapCluster(raft.Configuration{Servers: []raft.Server{{ID: conf.LocalID, Address: addr}}}).Error(); err != nil {
+		t.Fatalf("bootstrapping: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for r.State() != raft.Leader {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for a leader")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	r.Apply(encodeCommand(&Command{OpType: OpPut, Key: []byte("k"), Value: []byte("v")}), 0)
+	// Raft 把这条日志交给状态机后就推进了 AppliedIndex，而 Apply 仍被挡住
+	index := r.LastIndex()
+	for r.AppliedIndex() < index {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the write to be committed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	type result struct {
+		index uint64
+		err   error
+	}
+	read := make(chan result, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		index, err := x.waitForRead(ctx, r, ReadLinearizable)
+		read <- result{index, err}
+	}()
+	select {
+	case res := <-read:
+		t.Fatalf("read returned applied index %d (%v) before the FSM applied index %d", res.index, res.err, index)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// 已取消的请求不再等待状态机
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := x.waitForRead(cancelled, r, ReadLinearizable); toAPIError(err).Code != CodeTimeout {
+		t.Errorf("read of a cancelled request: got %v, want %s", err, CodeTimeout)
+	}
+
+	opened = true
+	close(fsm.gate)
+	res := <-read
+	if res.err != nil {
+		t.Fatalf("waitForRead: %v", res.err)
+	}
+	if res.index < index {
+		t.Errorf("applied index: got %d, want at least %d", res.index, index)
+	}
+	if x.db.Get([]byte("k")) == nil {
+		t.Errorf("write is not visible to the read")
+	}
+}
@@ -1,45 +1,326 @@
 package main
 
 import (
+	"bytes"
+	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"time"
+
+	pb "github.com/Jille/raft-grpc-example/proto"
 )
 
-var ConverterMap = map[string]func([]byte) interface{} {
-	"int": func(b []byte) interface{} {
-		return int(binary.BigEndian.Uint64(b))
+// ValueType describes how the values of one type are validated, stored and
+// read back. The name of the type a value was written with is stored in its
+// entry, so reads decode it without the client naming the type again.
+type ValueType struct {
+	// Encode converts a value decoded from a JSON request into stored bytes.
+	Encode func(v interface{}) ([]byte, error)
+	// Decode converts stored bytes into a value that encodes to JSON.
+	Decode func(b []byte) (interface{}, error)
+}
+
+// ValueTypes are the supported value types by name.
+//
+//	int       JSON integer, stored as 8 byte big endian
+//	float     JSON number, stored as 8 byte big endian IEEE 754
+//	string    JSON string, stored verbatim
+//	bool      JSON boolean, stored as "1" or "0"
+//	bytes     base64 encoded JSON string, stored decoded
+//	timestamp RFC 3339 JSON string, stored as 8 byte big endian unix nano
+//	list      JSON array, stored as JSON
+//	json      any JSON value, stored as JSON
+var ValueTypes = map[string]*ValueType{
+	"int": {
+		Encode: func(v interface{}) ([]byte, error) {
+			i, ok := integerValue(v)
+			if !ok {
+				return nil, valueTypeError("int", v)
+			}
+			return encodeInt(i), nil
+		},
+		Decode: func(b []byte) (interface{}, error) {
+			if len(b) != 8 {
+				return nil, storedTypeError("int", b)
+			}
+			return int64(binary.BigEndian.Uint64(b)), nil
+		},
+	},
+	"float": {
+		Encode: func(v interface{}) ([]byte, error) {
+			f, ok := v.(float64)
+			if n, isNumber := v.(json.Number); isNumber {
+				var err error
+				f, err = n.Float64()
+				ok = err == nil
+			}
+			if !ok {
+				return nil, valueTypeError("float", v)
+			}
+			return encodeFloat(f)
+		},
+		Decode: func(b []byte) (interface{}, error) {
+			if len(b) != 8 {
+				return nil, storedTypeError("float", b)
+			}
+			return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+		},
+	},
+	"string": {
+		Encode: func(v interface{}) ([]byte, error) {
+			s, ok := v.(string)
+			if !ok {
+				return nil, valueTypeError("string", v)
+			}
+			return []byte(s), nil
+		},
+		Decode: func(b []byte) (interface{}, error) {
+			return string(b), nil
+		},
+	},
+	"bool": {
+		Encode: func(v interface{}) ([]byte, error) {
+			boolValue, ok := v.(bool)
+			if !ok {
+				return nil, valueTypeError("bool", v)
+			}
+			return encodeBool(boolValue), nil
+		},
+		Decode: func(b []byte) (interface{}, error) {
+			switch string(b) {
+			case "1":
+				return true, nil
+			case "0":
+				return false, nil
+			}
+			return nil, storedTypeError("bool", b)
+		},
 	},
-	"string": func(b []byte) interface{} {
-		return string(b)
+	"bytes": {
+		Encode: func(v interface{}) ([]byte, error) {
+			s, ok := v.(string)
+			if !ok {
+				return nil, valueTypeError("bytes", v)
+			}
+			b, err := base64.StdEncoding.DecodeString(s)
+			if err != nil {
+				return nil, fmt.Errorf("bytes value is not valid base64: %v", err)
+			}
+			return b, nil
+		},
+		Decode: func(b []byte) (interface{}, error) {
+			return base64.StdEncoding.EncodeToString(b), nil
+		},
 	},
-	"bool": func(b []byte) interface{} {
-		return string(b) == "1"
+	"timestamp": {
+		Encode: func(v interface{}) ([]byte, error) {
+			s, ok := v.(string)
+			if !ok {
+				return nil, valueTypeError("timestamp", v)
+			}
+			t, err := time.Parse(time.RFC3339Nano, s)
+			if err != nil {
+				return nil, fmt.Errorf("timestamp value is not RFC 3339: %v", err)
+			}
+			return encodeInt(t.UnixNano()), nil
+		},
+		Decode: func(b []byte) (interface{}, error) {
+			if len(b) != 8 {
+				return nil, storedTypeError("timestamp", b)
+			}
+			return time.Unix(0, int64(binary.BigEndian.Uint64(b))).UTC(), nil
+		},
 	},
-	"json": func(b []byte) interface{} {
-		var mapResult map[string]interface{}
-		json.Unmarshal(b, &mapResult)
-		return mapResult
+	"list": {
+		Encode: func(v interface{}) ([]byte, error) {
+			if _, ok := v.([]interface{}); !ok {
+				return nil, valueTypeError("list", v)
+			}
+			return json.Marshal(v)
+		},
+		Decode: func(b []byte) (interface{}, error) {
+			if !isJSONArray(b) {
+				return nil, storedTypeError("list", b)
+			}
+			return json.RawMessage(b), nil
+		},
 	},
+	"json": {
+		Encode: func(v interface{}) ([]byte, error) {
+			return json.Marshal(v)
+		},
+		Decode: func(b []byte) (interface{}, error) {
+			if !json.Valid(b) {
+				return nil, storedTypeError("json", b)
+			}
+			return json.RawMessage(b), nil
+		},
+	},
+}
+
+var errUntypedValue = errors.New("value was stored without a type, type is required to read it")
+
+func valueTypeError(t string, v interface{}) error {
+	return fmt.Errorf("value of type %T cannot be stored as %s", v, t)
+}
+
+func storedTypeError(t string, b []byte) error {
+	return fmt.Errorf("stored value of %d bytes cannot be read as %s", len(b), t)
+}
+
+// checkType validates the type of a read request. An empty type is allowed,
+// values are read as the type they were written with.
+func checkType(t string) error {
+	if _, ok := ValueTypes[t]; !ok && t != "" {
+		return fmt.Errorf("requested type [%v] is not supported", t)
+	}
+	return nil
+}
+
+// inferType returns the type a JSON value is stored as when a write does not
+// name one.
+func inferType(v interface{}) string {
+	switch v.(type) {
+	case string:
+		return "string"
+	case bool:
+		return "bool"
+	case float64, json.Number:
+		if _, ok := integerValue(v); ok {
+			return "int"
+		}
+		return "float"
+	case []interface{}:
+		return "list"
+	default:
+		return "json"
+	}
+}
+
+// integerValue returns v as int64 if it is a JSON number without fraction that
+// fits. Integers beyond 2^53 have already lost precision when decoded as float64.
+func integerValue(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case float64:
+		if n != math.Trunc(n) || n < -(1<<63) || n >= 1<<63 {
+			return 0, false
+		}
+		return int64(n), true
+	case json.Number:
+		i, err := n.Int64()
+		return i, err == nil
+	}
+	return 0, false
 }
 
 func ConvertToBytes(t string, data interface{}) ([]byte, error) {
-	if t == "int" {
-		result := make([]byte, 8)
-		binary.BigEndian.PutUint64(result, uint64(int(data.(float64))))
-		return result, nil
-	} else if t == "string" {
-		return []byte(data.(string)), nil
-	} else if t == "bool" {
-		if boolValue := data.(bool); boolValue {
-			return []byte("1"), nil
-		} else {
-			return []byte("0"), nil
+	vt, ok := ValueTypes[t]
+	if !ok {
+		return nil, fmt.Errorf("unsupported type [%v]", t)
+	}
+	return vt.Encode(data)
+}
+
+// DecodeValue decodes the value of e as the type it was written with and
+// returns that type together with the value. t is only used for values
+// written before types were stored.
+func DecodeValue(e *entry, t string) (string, interface{}, error) {
+	if e.Type != "" {
+		t = e.Type
+	}
+	if t == "" {
+		return "", nil, errUntypedValue
+	}
+	vt, ok := ValueTypes[t]
+	if !ok {
+		return "", nil, fmt.Errorf("unsupported type [%v]", t)
+	}
+	v, err := vt.Decode(e.Value)
+	return t, v, err
+}
+
+// ValueToBytes encodes a typed gRPC value exactly like ConvertToBytes encodes
+// the corresponding HTTP value, and returns the name of its type.
+func ValueToBytes(v *pb.Value) (string, []byte, error) {
+	switch k := v.GetKind().(type) {
+	case *pb.Value_IntValue:
+		return "int", encodeInt(k.IntValue), nil
+	case *pb.Value_FloatValue:
+		b, err := encodeFloat(k.FloatValue)
+		return "float", b, err
+	case *pb.Value_StringValue:
+		return "string", []byte(k.StringValue), nil
+	case *pb.Value_BoolValue:
+		return "bool", encodeBool(k.BoolValue), nil
+	case *pb.Value_BytesValue:
+		return "bytes", k.BytesValue, nil
+	case *pb.Value_TimestampValue:
+		return "timestamp", encodeInt(k.TimestampValue), nil
+	case *pb.Value_ListValue:
+		if !isJSONArray([]byte(k.ListValue)) {
+			return "", nil, errors.New("list_value is not a json array")
+		}
+		return "list", []byte(k.ListValue), nil
+	case *pb.Value_JsonValue:
+		if !json.Valid([]byte(k.JsonValue)) {
+			return "", nil, errors.New("json_value is not valid json")
 		}
-	} else if t == "json" {
-		return json.Marshal(data)
-	} else {
-		return nil, errors.New(fmt.Sprintf("unsupported type [%v]", t))
+		return "json", []byte(k.JsonValue), nil
+	default:
+		return "", nil, errors.New("value is required")
+	}
+}
+
+// BytesToValue decodes a stored value as type t, see ValueTypes.
+func BytesToValue(t string, b []byte) (*pb.Value, error) {
+	vt, ok := ValueTypes[t]
+	if !ok {
+		return nil, fmt.Errorf("unsupported type [%v]", t)
+	}
+	v, err := vt.Decode(b)
+	if err != nil {
+		return nil, err
+	}
+	switch t {
+	case "int":
+		return &pb.Value{Kind: &pb.Value_IntValue{IntValue: v.(int64)}}, nil
+	case "float":
+		return &pb.Value{Kind: &pb.Value_FloatValue{FloatValue: v.(float64)}}, nil
+	case "string":
+		return &pb.Value{Kind: &pb.Value_StringValue{StringValue: v.(string)}}, nil
+	case "bool":
+		return &pb.Value{Kind: &pb.Value_BoolValue{BoolValue: v.(bool)}}, nil
+	case "bytes":
+		return &pb.Value{Kind: &pb.Value_BytesValue{BytesValue: b}}, nil
+	case "timestamp":
+		return &pb.Value{Kind: &pb.Value_TimestampValue{TimestampValue: v.(time.Time).UnixNano()}}, nil
+	case "list":
+		return &pb.Value{Kind: &pb.Value_ListValue{ListValue: string(b)}}, nil
+	default:
+		return &pb.Value{Kind: &pb.Value_JsonValue{JsonValue: string(b)}}, nil
+	}
+}
+
+func encodeFloat(f float64) ([]byte, error) {
+	// JSON 无法表示 NaN 与无穷大，写入后将无法读出
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, fmt.Errorf("float value %v is not representable in json", f)
 	}
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, math.Float64bits(f))
+	return b, nil
+}
+
+func encodeBool(v bool) []byte {
+	if v {
+		return []byte("1")
+	}
+	return []byte("0")
+}
+
+func isJSONArray(b []byte) bool {
+	return json.Valid(b) && bytes.HasPrefix(bytes.TrimLeft(b, " \t\r\n"), []byte("["))
 }
@@ -2,24 +2,47 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"time"
+
 	"github.com/gin-gonic/gin"
 )
 
+// Command is the unit replicated through the Raft log. The json tags are kept
+// so that entries written by older versions can still be replayed.
 type Command struct {
-	OpType int `json:"op_type"`
-	Key []byte `json:"key"`
-	Value []byte `json:"value"`
-	TrxID uint32 `json:"trx_id"`
+	OpType       int        `json:"op_type"`
+	Key          []byte     `json:"key"`
+	Value        []byte     `json:"value"`
+	TrxID        uint64     `json:"trx_id"`
+	Ops          []*Command `json:"ops,omitempty"`  // OpBatch 中的子操作
+	Time         int64      `json:"time,omitempty"` // 提交命令时 leader 的时间（unix nano），状态机用它代替本地时钟
+	TTL          int64      `json:"ttl,omitempty"`  // 租约时长（纳秒）
+	Cond         int        `json:"cond,omitempty"` // 写入条件，见 conditional.go
+	CondValue    []byte     `json:"cond_value,omitempty"`
+	CondVersion  uint64     `json:"cond_version,omitempty"`
+	CondRevision uint64     `json:"cond_revision,omitempty"`
+	Revision     uint64     `json:"revision,omitempty"` // 写入所在日志的 index，由状态机填写，用于快照中重放事务
+	LeaseID      uint64     `json:"lease_id,omitempty"` // put 时挂载的租约，租约相关命令操作的租约
+	Delta        int64      `json:"delta,omitempty"`    // OpIncr 使用，见 incr.go
+	Initial      int64      `json:"initial,omitempty"`
+	Min          *int64     `json:"min,omitempty"`
+	Max          *int64     `json:"max,omitempty"`
+	ValueType    string     `json:"value_type,omitempty"` // 写入值的类型，随值一起保存，见 converter.go
+	Path         string     `json:"path,omitempty"`       // JSON 文档操作的 JSON pointer，见 jsondoc.go
+
+	legacy bool // 由旧版本以 JSON 格式写入，TrxID 是 drifterdb 的事务号
 }
 
+// ToBytes encodes the command for the Raft log, see codec.go for the format.
 func (c *Command) ToBytes() ([]byte, error) {
-	return json.Marshal(c)
+	return encodeCommand(c), nil
 }
 
 func Success(data interface{}, message string, details interface{}) map[string]interface{} {
 	return gin.H{
 		"success": true,
-		"data": data,
+		"data":    data,
 		"message": message,
 		"details": details,
 	}
@@ -28,33 +51,163 @@ func Success(data interface{}, message string, details interface{}) map[string]i
 func Fail(data interface{}, message string, details interface{}) map[string]interface{} {
 	return gin.H{
 		"success": false,
-		"data": data,
+		"data":    data,
 		"message": message,
 		"details": details,
 	}
 }
 
 type ReqBody struct {
-	Key string `json:"key"`
-	Value interface{} `json:"value"`
-	Type string `json:"type"` // int string bool json
-	TrxID uint32 `json:"trx_id"`
+	Key         string      `json:"key"`
+	Value       interface{} `json:"value"`
+	Type        string      `json:"type"` // 见 ValueTypes，省略时根据 value 推断
+	TrxID       uint64      `json:"trx_id"`
+	Consistency string      `json:"consistency"` // 读请求使用：stale leader linearizable，默认 linearizable
+	TTL         int64       `json:"ttl"`         // put 使用：key 的存活时间（秒），0 表示永不过期
+	Lease       uint64      `json:"lease"`       // put 使用：挂载到该租约上，租约撤销或过期时 key 被删除
+	Fields      []string    `json:"fields"`      // get 使用：只返回 json 值中这些 JSON pointer 处的字段
+	Preconditions
+}
+
+// Preconditions 用于条件写入，最多指定一个；if_value_equals 的类型同 type
+type Preconditions struct {
+	IfAbsent            bool        `json:"if_absent"`
+	IfValueEquals       interface{} `json:"if_value_equals"`
+	IfVersionEquals     *uint64     `json:"if_version_equals"`
+	IfModRevisionEquals *uint64     `json:"if_mod_revision_equals"`
+}
+
+type CASParams struct {
+	Key      string      `json:"key"`
+	Expected interface{} `json:"expected"` // 为 null 表示期望 key 不存在
+	Value    interface{} `json:"value"`
+	Type     string      `json:"type"` // expected 与 value 的类型
+	TrxID    uint64      `json:"trx_id"`
+	TTL      int64       `json:"ttl"`
+}
+
+type IncrParams struct {
+	Key     string `json:"key"`
+	Delta   *int64 `json:"delta"`   // 省略时为 1
+	Initial int64  `json:"initial"` // key 不存在时的初始值
+	Min     *int64 `json:"min"`     // 可选，结果超出 [min, max] 时不写入
+	Max     *int64 `json:"max"`
+	TrxID   uint64 `json:"trx_id"`
+}
+
+type JSONParams struct {
+	Key   string          `json:"key"`
+	Op    string          `json:"op"`    // merge set remove append
+	Path  string          `json:"path"`  // JSON pointer，为空表示整个文档
+	Value json.RawMessage `json:"value"` // 保留原始文本，避免大整数经 float64 丢失精度
+	TrxID uint64          `json:"trx_id"`
+}
+
+type LeaseParams struct {
+	ID  uint64 `json:"id"`
+	TTL int    `json:"ttl"` // 授予租约时使用：租约时长（秒），0 表示使用默认值
 }
 
 type TrxParams struct {
-	TrxID uint32 `json:"trx_id"`
+	TrxID uint64 `json:"trx_id"`
+	TTL   int    `json:"ttl"` // 开启事务时使用：租约时长（秒），0 表示使用默认值
 }
 
 type RangeParams struct {
-	StartKey string `json:"start_key"`
-	EndKey string `json:"end_key"`
-	Offset int `json:"offset"`
-	Count int `json:"count"`
-	Type string `json:"type"`
-	TrxID uint32 `json:"trx_id"`
+	StartKey    string   `json:"start_key"` // 包含
+	EndKey      string   `json:"end_key"`   // 不包含，为空时扫描到末尾
+	Prefix      string   `json:"prefix"`
+	Reverse     bool     `json:"reverse"`
+	Limit       int      `json:"limit"`
+	Token       string   `json:"token"` // 上一页返回的 next_token
+	Type        string   `json:"type"`
+	TrxID       uint64   `json:"trx_id"`
+	Consistency string   `json:"consistency"`
+	Fields      []string `json:"fields"` // 同 ReqBody.Fields
 }
 
 type KV struct {
-	Key string `json:"key"`
+	Key            string      `json:"key"`
+	Value          interface{} `json:"value"`
+	Type           string      `json:"type,omitempty"`
+	CreateRevision uint64      `json:"create_revision"`
+	ModRevision    uint64      `json:"mod_revision"`
+	Version        uint64      `json:"version"`
+	ExpiresAt      *time.Time  `json:"expires_at,omitempty"`
+}
+
+// NewKV fills a KV from the stored entry of key, decoding the value as the
+// type it was written with. t is used for values stored without a type.
+func NewKV(key string, e *entry, t string) (*KV, error) {
+	t, value, err := DecodeValue(e, t)
+	if err != nil {
+		return nil, fmt.Errorf("key %q: %v", key, err)
+	}
+	kv := &KV{
+		Key:            key,
+		Value:          value,
+		Type:           t,
+		CreateRevision: e.CreateRevision,
+		ModRevision:    e.ModRevision,
+		Version:        e.Version,
+	}
+	if e.ExpiresAt != 0 {
+		expiresAt := time.Unix(0, e.ExpiresAt)
+		kv.ExpiresAt = &expiresAt
+	}
+	return kv, nil
+}
+
+// Project replaces the value of kv with the fields selected from the json or
+// list value of e, see projectDocument. It does nothing if fields is empty.
+func (kv *KV) Project(e *entry, fields []string) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	v, err := projectDocument(e, kv.Type, fields)
+	if err != nil {
+		return fmt.Errorf("key %q: %v", kv.Key, err)
+	}
+	kv.Value = v
+	return nil
+}
+
+type BatchOp struct {
+	Op    string      `json:"op"` // put delete
+	Key   string      `json:"key"`
 	Value interface{} `json:"value"`
-}
\ No newline at end of file
+	Type  string      `json:"type"`
+	TTL   int64       `json:"ttl"`
+	Lease uint64      `json:"lease"`
+	Preconditions
+}
+
+type BatchParams struct {
+	Ops   []BatchOp `json:"ops"`
+	TrxID uint64    `json:"trx_id"`
+}
+
+// BatchResult is what DrifterX.Apply returns for an OpBatch command.
+type BatchResult struct {
+	Index     uint64     `json:"index"`
+	Committed bool       `json:"committed"`
+	Results   []OpResult `json:"results"`
+}
+
+type OpResult struct {
+	Key   string `json:"key"`
+	Error string `json:"error,omitempty"`
+}
+
+// WatchParams 通过 query string 传递，便于浏览器的 EventSource 直接使用
+type WatchParams struct {
+	Key           string `form:"key"`
+	Prefix        bool   `form:"prefix"`
+	StartRevision uint64 `form:"start_revision"` // 0 表示从下一次变更开始
+	Type          string `form:"type"`
+}
+
+type WatchEvent struct {
+	KV
+	Revision uint64 `json:"revision"`
+}
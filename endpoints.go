@@ -0,0 +1,373 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hashicorp/raft"
+)
+
+// 所有写接口共用同一条处理流程：绑定请求体、构造命令、提交到 Raft、
+// 等待状态机应用并输出统一的响应。新增一种写命令只需定义请求类型并在
+// writeEndpoints 中登记。leader 的判断由路由上的 leaderForwarder 中间件完成。
+
+// writeRequest is the body of a write endpoint.
+type writeRequest interface {
+	// command validates the request and builds the command it submits.
+	command() (*Command, error)
+}
+
+// writeResponder is implemented by write requests whose response carries more
+// than the commit index. It returns the data and details of the response from
+// the commit index and the FSM response; the data must include the commit
+// index as "index", like that of every other write.
+type writeResponder interface {
+	response(index uint64, resp interface{}) (interface{}, interface{})
+}
+
+// writeEndpoint is a registered write endpoint.
+type writeEndpoint struct {
+	path string
+	// request returns a fresh request the body is bound to.
+	request func() writeRequest
+	// optionalBody allows requests without body, leaving the request zero.
+	optionalBody bool
+}
+
+// writeEndpoints are the write endpoints, served by the leader.
+var writeEndpoints = []writeEndpoint{
+	{path: "/db/put", request: func() writeRequest { return &putRequest{} }},
+	{path: "/db/delete", request: func() writeRequest { return &deleteRequest{} }},
+	{path: "/db/batch", request: func() writeRequest { return &batchRequest{} }},
+	{path: "/db/cas", request: func() writeRequest { return &casRequest{} }},
+	{path: "/db/incr", request: func() writeRequest { return &incrRequest{} }},
+	{path: "/db/json", request: func() writeRequest { return &jsonRequest{} }},
+	{path: "/db/start-transaction", request: func() writeRequest { return &startTrxRequest{} }, optionalBody: true},
+	{path: "/db/commit-transaction", request: func() writeRequest { return &commitTrxRequest{} }},
+	{path: "/db/rollback-transaction", request: func() writeRequest { return &rollbackTrxRequest{} }},
+	{path: "/db/keepalive-transaction", request: func() writeRequest { return &keepAliveTrxRequest{} }},
+	{path: "/db/grant-lease", request: func() writeRequest { return &grantLeaseRequest{} }, optionalBody: true},
+	{path: "/db/revoke-lease", request: func() writeRequest { return &revokeLeaseRequest{} }},
+	{path: "/db/keepalive-lease", request: func() writeRequest { return &keepAliveLeaseRequest{} }},
+}
+
+// handler returns the gin handler of e. Commands are applied within the
+// deadline of the HTTP request, or rpcTimeout if it has none.
+func (e writeEndpoint) handler(r *raft.Raft) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		req := e.request()
+		if !e.optionalBody || c.Request.ContentLength != 0 {
+			if err := c.ShouldBindJSON(req); err != nil {
+				writeError(c, newAPIError(CodeInvalidArgument, err.Error()))
+				return
+			}
+		}
+		cmd, err := req.command()
+		if err != nil {
+			writeError(c, newAPIError(CodeInvalidArgument, err.Error()))
+			return
+		}
+		index, resp, err := applyCommand(c.Request.Context(), r, cmd)
+		if err != nil {
+			applyError(c, r, err)
+			return
+		}
+		if responder, ok := req.(writeResponder); ok {
+			data, details := responder.response(index, resp)
+			c.JSON(200, Success(data, "", details))
+			return
+		}
+		c.JSON(200, Success(gin.H{"index": index}, "", nil))
+	}
+}
+
+type putRequest struct {
+	ReqBody
+}
+
+func (p *putRequest) command() (*Command, error) {
+	if p.Type == "" {
+		p.Type = inferType(p.Value)
+	}
+	value, err := ConvertToBytes(p.Type, p.Value)
+	if err != nil {
+		return nil, err
+	}
+	if p.TTL < 0 {
+		return nil, errors.New("ttl must not be negative")
+	}
+	cmd := &Command{
+		OpType:    OpPut,
+		Key:       []byte(p.Key),
+		Value:     value,
+		ValueType: p.Type,
+		TrxID:     p.TrxID,
+		TTL:       keyTTL(p.TTL),
+		LeaseID:   p.Lease,
+	}
+	return cmd, setPreconditions(cmd, p.Preconditions, p.Type)
+}
+
+type deleteRequest struct {
+	ReqBody
+}
+
+func (p *deleteRequest) command() (*Command, error) {
+	cmd := &Command{
+		OpType: OpDel,
+		Key:    []byte(p.Key),
+		TrxID:  p.TrxID,
+	}
+	return cmd, setPreconditions(cmd, p.Preconditions, p.Type)
+}
+
+// batchRequest applies put and delete operations atomically. If an operation
+// fails nothing is written and the request fails with PRECONDITION_FAILED,
+// listing the failed operations in details.failures.
+type batchRequest struct {
+	BatchParams
+}
+
+func (p *batchRequest) command() (*Command, error) {
+	ops := make([]*Command, 0, len(p.Ops))
+	for i, op := range p.Ops {
+		switch op.Op {
+		case "put":
+			if op.Type == "" {
+				op.Type = inferType(op.Value)
+			}
+			value, err := ConvertToBytes(op.Type, op.Value)
+			if err != nil {
+				return nil, fmt.Errorf("ops[%d]: %v", i, err)
+			}
+			if op.TTL < 0 {
+				return nil, fmt.Errorf("ops[%d]: ttl must not be negative", i)
+			}
+			ops = append(ops, &Command{
+				OpType:    OpPut,
+				Key:       []byte(op.Key),
+				Value:     value,
+				ValueType: op.Type,
+				TTL:       keyTTL(op.TTL),
+				LeaseID:   op.Lease,
+			})
+		case "delete":
+			ops = append(ops, &Command{OpType: OpDel, Key: []byte(op.Key)})
+		default:
+			return nil, fmt.Errorf("ops[%d]: unsupported op [%v]", i, op.Op)
+		}
+		if err := setPreconditions(ops[len(ops)-1], op.Preconditions, op.Type); err != nil {
+			return nil, fmt.Errorf("ops[%d]: %v", i, err)
+		}
+	}
+	return &Command{OpType: OpBatch, TrxID: p.TrxID, Ops: ops}, nil
+}
+
+func (p *batchRequest) response(index uint64, resp interface{}) (interface{}, interface{}) {
+	return resp, nil
+}
+
+// casRequest writes value only if the key currently holds expected, where a
+// null expected means the key must not exist.
+type casRequest struct {
+	CASParams
+}
+
+func (p *casRequest) command() (*Command, error) {
+	if p.Type == "" {
+		p.Type = inferType(p.Value)
+	}
+	value, err := ConvertToBytes(p.Type, p.Value)
+	if err != nil {
+		return nil, err
+	}
+	var expected []byte
+	if p.Expected != nil {
+		if expected, err = ConvertToBytes(p.Type, p.Expected); err != nil {
+			return nil, err
+		}
+	}
+	if p.TTL < 0 {
+		return nil, errors.New("ttl must not be negative")
+	}
+	return &Command{
+		OpType:    OpCAS,
+		Key:       []byte(p.Key),
+		Value:     value,
+		ValueType: p.Type,
+		TrxID:     p.TrxID,
+		CondValue: expected,
+		TTL:       keyTTL(p.TTL),
+	}, nil
+}
+
+// incrRequest atomically adds delta to the int stored under key and responds
+// with the new value.
+type incrRequest struct {
+	IncrParams
+}
+
+func (p *incrRequest) command() (*Command, error) {
+	delta := int64(1)
+	if p.Delta != nil {
+		delta = *p.Delta
+	}
+	if p.Min != nil && p.Max != nil && *p.Min > *p.Max {
+		return nil, errors.New("min must not be greater than max")
+	}
+	return &Command{
+		OpType:  OpIncr,
+		Key:     []byte(p.Key),
+		TrxID:   p.TrxID,
+		Delta:   delta,
+		Initial: p.Initial,
+		Min:     p.Min,
+		Max:     p.Max,
+	}, nil
+}
+
+func (p *incrRequest) response(index uint64, resp interface{}) (interface{}, interface{}) {
+	return gin.H{"value": resp, "index": index}, nil
+}
+
+// jsonOps maps the op of a JSONParams to its command.
+var jsonOps = map[string]int{
+	"merge":  OpJSONMerge,
+	"set":    OpJSONSet,
+	"remove": OpJSONRemove,
+	"append": OpJSONAppend,
+}
+
+// jsonRequest updates part of the json document stored under a key: merge
+// applies value as a JSON merge patch, set replaces, remove deletes and append
+// appends value to the array at path. It responds with the resulting document.
+type jsonRequest struct {
+	JSONParams
+}
+
+func (p *jsonRequest) command() (*Command, error) {
+	op, ok := jsonOps[p.Op]
+	if !ok {
+		return nil, fmt.Errorf("unsupported op [%v]", p.Op)
+	}
+	if err := checkPointers([]string{p.Path}); err != nil {
+		return nil, err
+	}
+	if op != OpJSONRemove && len(p.Value) == 0 {
+		return nil, errors.New("value is required")
+	}
+	return &Command{
+		OpType: op,
+		Key:    []byte(p.Key),
+		Value:  p.Value,
+		Path:   p.Path,
+		TrxID:  p.TrxID,
+	}, nil
+}
+
+func (p *jsonRequest) response(index uint64, resp interface{}) (interface{}, interface{}) {
+	return gin.H{"value": resp, "index": index}, nil
+}
+
+// startTrxRequest opens a transaction. The body is optional and may set the
+// TTL of its lease in seconds.
+type startTrxRequest struct {
+	TrxParams
+}
+
+func (p *startTrxRequest) command() (*Command, error) {
+	return &Command{OpType: OpTrx, TTL: int64(normalizeTrxTTL(time.Duration(p.TTL) * time.Second))}, nil
+}
+
+func (p *startTrxRequest) response(index uint64, resp interface{}) (interface{}, interface{}) {
+	return gin.H{
+		"trx_id": resp,
+		"ttl":    normalizeTrxTTL(time.Duration(p.TTL) * time.Second).Seconds(),
+		"index":  index,
+	}, nil
+}
+
+type commitTrxRequest struct {
+	TrxParams
+}
+
+func (p *commitTrxRequest) command() (*Command, error) {
+	return &Command{OpType: OpCmt, TrxID: p.TrxID}, nil
+}
+
+type rollbackTrxRequest struct {
+	TrxParams
+}
+
+func (p *rollbackTrxRequest) command() (*Command, error) {
+	return &Command{OpType: OpRol, TrxID: p.TrxID}, nil
+}
+
+// keepAliveTrxRequest renews the lease of a transaction. Clients have to send
+// it more often than the ttl returned when the transaction was opened,
+// otherwise the leader rolls the transaction back.
+type keepAliveTrxRequest struct {
+	TrxParams
+}
+
+func (p *keepAliveTrxRequest) command() (*Command, error) {
+	return &Command{OpType: OpTrxKeepAlive, TrxID: p.TrxID}, nil
+}
+
+func (p *keepAliveTrxRequest) response(index uint64, resp interface{}) (interface{}, interface{}) {
+	info, _ := resp.(*TrxInfo)
+	return trxResponse{TrxInfo: info, Index: index}, nil
+}
+
+// trxResponse is the data of a write that returns a transaction: its fields
+// and, like every write, the commit index.
+type trxResponse struct {
+	*TrxInfo
+	Index uint64 `json:"index"`
+}
+
+// grantLeaseRequest grants a lease. The body is optional and may set the TTL
+// in seconds.
+type grantLeaseRequest struct {
+	LeaseParams
+}
+
+func (p *grantLeaseRequest) command() (*Command, error) {
+	return &Command{OpType: OpLeaseGrant, TTL: int64(normalizeLeaseTTL(time.Duration(p.TTL) * time.Second))}, nil
+}
+
+func (p *grantLeaseRequest) response(index uint64, resp interface{}) (interface{}, interface{}) {
+	info, _ := resp.(*LeaseInfo)
+	return leaseResponse{LeaseInfo: info, Index: index}, nil
+}
+
+// leaseResponse is the data of a write that returns a lease: its fields and,
+// like every write, the commit index.
+type leaseResponse struct {
+	*LeaseInfo
+	Index uint64 `json:"index"`
+}
+
+// revokeLeaseRequest revokes a lease and deletes the keys attached to it.
+type revokeLeaseRequest struct {
+	LeaseParams
+}
+
+func (p *revokeLeaseRequest) command() (*Command, error) {
+	return &Command{OpType: OpLeaseRevoke, LeaseID: p.ID}, nil
+}
+
+type keepAliveLeaseRequest struct {
+	LeaseParams
+}
+
+func (p *keepAliveLeaseRequest) command() (*Command, error) {
+	return &Command{OpType: OpLeaseKeepAlive, LeaseID: p.ID}, nil
+}
+
+func (p *keepAliveLeaseRequest) response(index uint64, resp interface{}) (interface{}, interface{}) {
+	info, _ := resp.(*LeaseInfo)
+	return leaseResponse{LeaseInfo: info, Index: index}, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestWriteEndpointsReturnIndex calls every write endpoint and checks that
+// the response data carries the commit index.
+func TestWriteEndpointsReturnIndex(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	c := newTestCluster(t, 1, nil)
+	defer c.shutdown()
+	leader := c.leader()
+	router := gin.New()
+	for _, e := range writeEndpoints {
+		router.POST(e.path, e.handler(leader.raft))
+	}
+
+	// 后面的请求引用前面的请求开启的事务与授予的租约
+	var trxID, leaseID uint64
+	tested := map[string]bool{}
+	call := func(path, body string) map[string]interface{} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(rec, req)
+		var resp struct {
+			Success bool                   `json:"success"`
+			Data    map[string]interface{} `json:"data"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || !resp.Success {
+			t.Fatalf("%s: %d %s", path, rec.Code, rec.Body)
+		}
+		return resp.Data
+	}
+	for _, tc := range []struct {
+		path string
+		body func() string
+	}{
+		{"/db/put", func() string { return `{"key":"k","value":"v"}` }},
+		{"/db/cas", func() string { return `{"key":"k","expected":"v","value":"w"}` }},
+		{"/db/delete", func() string { return `{"key":"k"}` }},
+		{"/db/batch", func() string { return `{"ops":[{"op":"put","key":"b","value":"v"}]}` }},
+		{"/db/incr", func() string { return `{"key":"n"}` }},
+		{"/db/json", func() string { return `{"key":"j","op":"merge","value":{"a":1}}` }},
+		{"/db/start-transaction", func() string { return "" }},
+		{"/db/keepalive-transaction", func() string { return fmt.Sprintf(`{"trx_id":%d}`, trxID) }},
+		{"/db/commit-transaction", func() string { return fmt.Sprintf(`{"trx_id":%d}`, trxID) }},
+		{"/db/start-transaction", func() string { return "" }},
+		{"/db/rollback-transaction", func() string { return fmt.Sprintf(`{"trx_id":%d}`, trxID) }},
+		{"/db/grant-lease", func() string { return "" }},
+		{"/db/keepalive-lease", func() string { return fmt.Sprintf(`{"id":%d}`, leaseID) }},
+		{"/db/revoke-lease", func() string { return fmt.Sprintf(`{"id":%d}`, leaseID) }},
+	} {
+		tested[tc.path] = true
+		data := call(tc.path, tc.body())
+		index, ok := data["index"].(float64)
+		if !ok || index == 0 {
+			t.Errorf("%s: data %v has no commit index", tc.path, data)
+		}
+		switch tc.path {
+		case "/db/start-transaction":
+			trxID = uint64(data["trx_id"].(float64))
+		case "/db/grant-lease":
+			leaseID = uint64(data["id"].(float64))
+		}
+	}
+	// 新增的写接口也必须加入上面的表
+	for _, e := range writeEndpoints {
+		if !tested[e.path] {
+			t.Errorf("%s is not tested", e.path)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// 写入 drifterdb 的值都带有一个信封，记录该 key 的元数据：
+//
+//	entryMagic(3 bytes) | field*
+//
+// 字段与命令使用相同的 uvarint(tag) | uvarint(len) | payload 编码。
+// 不以 entryMagic 开头的值是旧版本直接写入的原始值，按版本 1 处理，
+// 其 revision 未知，记为 0。
+var entryMagic = []byte{0xdf, 0x58, 0x01}
+
+const (
+	entryFieldValue = iota + 1
+	entryFieldVersion
+	entryFieldCreateRevision
+	entryFieldModRevision
+	entryFieldExpiresAt
+	entryFieldLease
+	entryFieldType
+)
+
+// entry is a stored value together with its metadata.
+type entry struct {
+	Value []byte
+	// Version counts the puts since the key was (re)created, starting at 1.
+	Version uint64
+	// CreateRevision is the log index of the write that (re)created the key,
+	// ModRevision the log index of its last write.
+	CreateRevision uint64
+	ModRevision    uint64
+	// ExpiresAt is when the key expires (unix nano), 0 if it does not.
+	ExpiresAt int64
+	// Lease is the lease the key is attached to, 0 if none.
+	Lease uint64
+	// Type is the value type the key was written with, see ValueTypes. It is
+	// empty for values written before types were stored.
+	Type string
+}
+
+func encodeEntry(e *entry) []byte {
+	buf := make([]byte, 0, len(entryMagic)+40+len(e.Value))
+	buf = append(buf, entryMagic...)
+	buf = appendField(buf, entryFieldValue, e.Value)
+	buf = appendUintField(buf, entryFieldVersion, e.Version)
+	buf = appendUintField(buf, entryFieldCreateRevision, e.CreateRevision)
+	buf = appendUintField(buf, entryFieldModRevision, e.ModRevision)
+	if e.ExpiresAt != 0 {
+		buf = appendUintField(buf, entryFieldExpiresAt, uint64(e.ExpiresAt))
+	}
+	if e.Lease != 0 {
+		buf = appendUintField(buf, entryFieldLease, e.Lease)
+	}
+	if e.Type != "" {
+		buf = appendField(buf, entryFieldType, []byte(e.Type))
+	}
+	return buf
+}
+
+// decodeEntry parses a value read from drifterdb. It returns nil for nil input.
+func decodeEntry(b []byte) (*entry, error) {
+	if b == nil {
+		return nil, nil
+	}
+	if !bytes.HasPrefix(b, entryMagic) {
+		return &entry{Value: b, Version: 1}, nil
+	}
+	e := &entry{Value: []byte{}}
+	b = b[len(entryMagic):]
+	for len(b) > 0 {
+		tag, payload, rest, err := nextField(b)
+		if err != nil {
+			return nil, fmt.Errorf("malformed stored value: %v", err)
+		}
+		b = rest
+		switch tag {
+		case entryFieldValue:
+			e.Value = payload
+		case entryFieldVersion:
+			e.Version, err = uintPayload(payload)
+		case entryFieldCreateRevision:
+			e.CreateRevision, err = uintPayload(payload)
+		case entryFieldModRevision:
+			e.ModRevision, err = uintPayload(payload)
+		case entryFieldExpiresAt:
+			var v uint64
+			v, err = uintPayload(payload)
+			e.ExpiresAt = int64(v)
+		case entryFieldLease:
+			e.Lease, err = uintPayload(payload)
+		case entryFieldType:
+			e.Type = string(payload)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("malformed stored value: %v", err)
+		}
+	}
+	return e, nil
+}
+
+// kvReader is implemented by drifterdb.BaseDB and *drifterdb.Transaction.
+type kvReader interface {
+	Get(key []byte) []byte
+}
+
+// kvWriter is implemented by drifterdb.BaseDB and *drifterdb.Transaction.
+type kvWriter interface {
+	kvReader
+	Put(key, value []byte) error
+	Delete(key []byte) error
+}
+
+// getEntry reads and decodes key, returning nil if it does not exist.
+// Expired entries that were not deleted yet are returned as well.
+func getEntry(r kvReader, key []byte) (*entry, error) {
+	return decodeEntry(r.Get(key))
+}
+
+// getLiveEntry reads key like getEntry but treats an entry that expired at now
+// (unix nano) as absent.
+func getLiveEntry(r kvReader, key []byte, now int64) (*entry, error) {
+	e, err := getEntry(r, key)
+	if err != nil || e.expired(now) {
+		return nil, err
+	}
+	return e, nil
+}
+
+// expired reports whether e has expired at now. A nil entry or a zero now
+// never has.
+func (e *entry) expired(now int64) bool {
+	return e != nil && e.ExpiresAt != 0 && now != 0 && e.ExpiresAt <= now
+}
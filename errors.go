@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Jille/raft-grpc-leader-rpc/rafterrors"
+	"github.com/gin-gonic/gin"
+	"github.com/golang/protobuf/proto"
+	"github.com/hashicorp/raft"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// ErrorCode is the stable, machine readable code of an API error. HTTP error
+// responses carry it in details.code, gRPC errors as the reason of an
+// ErrorInfo detail.
+type ErrorCode string
+
+const (
+	CodeInvalidArgument    ErrorCode = "INVALID_ARGUMENT"
+	CodeNotLeader          ErrorCode = "NOT_LEADER"
+	CodeNoLeader           ErrorCode = "NO_LEADER"
+	CodeLeadershipLost     ErrorCode = "LEADERSHIP_LOST"
+	CodeUnavailable        ErrorCode = "UNAVAILABLE"
+	CodeTimeout            ErrorCode = "TIMEOUT"
+	CodeTxnNotFound        ErrorCode = "TXN_NOT_FOUND"
+	CodeLeaseNotFound      ErrorCode = "LEASE_NOT_FOUND"
+	CodePreconditionFailed ErrorCode = "PRECONDITION_FAILED"
+	CodeTypeMismatch       ErrorCode = "TYPE_MISMATCH"
+	CodeOutOfRange         ErrorCode = "OUT_OF_RANGE"
+	CodeJSONPath           ErrorCode = "JSON_PATH"
+	CodeForwardFailed      ErrorCode = "FORWARD_FAILED"
+	CodeInternal           ErrorCode = "INTERNAL"
+)
+
+// errorDomain is the domain of the ErrorInfo details of gRPC errors.
+const errorDomain = "drifterx"
+
+// errorSpec describes how an error code is reported.
+type errorSpec struct {
+	httpStatus int
+	grpcCode   codes.Code
+	// messages 按语言保存，至少包含 defaultLanguage
+	messages map[string]string
+}
+
+var errorCatalog = map[ErrorCode]errorSpec{
+	CodeInvalidArgument: {400, codes.InvalidArgument, map[string]string{
+		"en": "invalid argument",
+		"zh": "参数格式错误",
+	}},
+	CodeNotLeader: {421, codes.Unavailable, map[string]string{
+		"en": "this node is not the leader",
+		"zh": "当前节点不是 leader",
+	}},
+	CodeNoLeader: {503, codes.Unavailable, map[string]string{
+		"en": "no leader is elected, retry once the election is over",
+		"zh": "当前没有 leader，请等待选举完成",
+	}},
+	CodeLeadershipLost: {503, codes.Unavailable, map[string]string{
+		"en": "leadership was lost, the write may or may not have been applied",
+		"zh": "leader 身份已丢失，写入可能已生效也可能未生效",
+	}},
+	CodeUnavailable: {503, codes.Unavailable, map[string]string{
+		"en": "the node is temporarily unavailable",
+		"zh": "节点暂时不可用",
+	}},
+	CodeTimeout: {504, codes.DeadlineExceeded, map[string]string{
+		"en": "the request timed out",
+		"zh": "请求超时",
+	}},
+	CodeTxnNotFound: {404, codes.NotFound, map[string]string{
+		"en": "transaction not found",
+		"zh": "未找到指定事务",
+	}},
+	CodeLeaseNotFound: {404, codes.NotFound, map[string]string{
+		"en": "lease not found",
+		"zh": "未找到指定租约",
+	}},
+	CodePreconditionFailed: {412, codes.FailedPrecondition, map[string]string{
+		"en": "precondition failed",
+		"zh": "写入条件不满足",
+	}},
+	CodeTypeMismatch: {409, codes.FailedPrecondition, map[string]string{
+		"en": "the stored value does not have the required type",
+		"zh": "存储的值类型不符",
+	}},
+	CodeOutOfRange: {409, codes.OutOfRange, map[string]string{
+		"en": "the result is out of range",
+		"zh": "结果超出范围",
+	}},
+	CodeJSONPath: {409, codes.FailedPrecondition, map[string]string{
+		"en": "the json path cannot be applied to the document",
+		"zh": "JSON 路径无法应用于该文档",
+	}},
+	CodeForwardFailed: {502, codes.Unavailable, map[string]string{
+		"en": "forwarding the request to the leader failed",
+		"zh": "转发请求到 leader 失败",
+	}},
+	CodeInternal: {500, codes.Internal, map[string]string{
+		"en": "internal error",
+		"zh": "内部错误",
+	}},
+}
+
+// grpcErrorCodes classifies gRPC errors that were created without a catalog
+// code, see completeStatus.
+var grpcErrorCodes = map[codes.Code]ErrorCode{
+	codes.InvalidArgument:    CodeInvalidArgument,
+	codes.FailedPrecondition: CodePreconditionFailed,
+	codes.OutOfRange:         CodeOutOfRange,
+	codes.DeadlineExceeded:   CodeTimeout,
+	codes.Unavailable:        CodeUnavailable,
+	codes.Internal:           CodeInternal,
+}
+
+const defaultLanguage = "en"
+
+// APIError is an error of the HTTP and gRPC API. Reason describes the cause in
+// English and is not localized.
+type APIError struct {
+	Code   ErrorCode
+	Reason string
+	// Leader is the address of the current leader of a NOT_LEADER error.
+	Leader string
+	// Failures are the failed operations of a batch.
+	Failures []OpFailure
+}
+
+// OpFailure is an operation of a batch that failed.
+type OpFailure struct {
+	Index int    `json:"index"`
+	Key   string `json:"key"`
+	Error string `json:"error"`
+}
+
+func (e *APIError) Error() string {
+	if e.Reason == "" {
+		return string(e.Code)
+	}
+	return string(e.Code) + ": " + e.Reason
+}
+
+func newAPIError(code ErrorCode, reason string) *APIError {
+	return &APIError{Code: code, Reason: reason}
+}
+
+// toAPIError classifies an error returned by Raft, the FSM or the API.
+func toAPIError(err error) *APIError {
+	var e *APIError
+	if errors.As(err, &e) {
+		return e
+	}
+	if be, ok := err.(*BatchError); ok {
+		return &APIError{Code: CodePreconditionFailed, Reason: be.Error(), Failures: be.failures()}
+	}
+	code := CodeInternal
+	switch err {
+	case errNotLeader, raft.ErrNotLeader:
+		code = CodeNotLeader
+	case raft.ErrLeadershipLost:
+		code = CodeLeadershipLost
+	case raft.ErrLeadershipTransferInProgress, raft.ErrRaftShutdown:
+		code = CodeUnavailable
+	case raft.ErrEnqueueTimeout, context.DeadlineExceeded, errApplyTimeout:
+		code = CodeTimeout
+	case errTrxNotFound:
+		code = CodeTxnNotFound
+	case errLeaseNotFound:
+		code = CodeLeaseNotFound
+	case errLeaseInTransaction, errUntypedValue, errReservedKey:
+		code = CodeInvalidArgument
+	case errPreconditionFailed:
+		code = CodePreconditionFailed
+	case errNotInteger, errNotJSONDocument:
+		code = CodeTypeMismatch
+	case errIncrOverflow:
+		code = CodeOutOfRange
+	}
+	switch err.(type) {
+	case *OutOfBoundsError, *CompactedError:
+		code = CodeOutOfRange
+	case *JSONPathError:
+		code = CodeJSONPath
+	}
+	return &APIError{Code: code, Reason: err.Error()}
+}
+
+// decodeError classifies an error of reading a stored value as requested.
+func decodeError(err error) *APIError {
+	if e := toAPIError(err); e.Code != CodeInternal {
+		return e
+	}
+	return newAPIError(CodeTypeMismatch, err.Error())
+}
+
+// leaderError returns the error of a request that only the leader can serve,
+// with the address of the current leader if there is one.
+func leaderError(r *raft.Raft, reason string) *APIError {
+	leader := string(r.Leader())
+	if leader == "" {
+		return newAPIError(CodeNoLeader, reason)
+	}
+	return &APIError{Code: CodeNotLeader, Reason: reason, Leader: leader}
+}
+
+// message returns the message of code in the preferred language of an
+// Accept-Language header.
+func (code ErrorCode) message(acceptLanguage string) string {
+	messages := errorCatalog[code].messages
+	for _, lang := range parseAcceptLanguage(acceptLanguage) {
+		if m, ok := messages[lang]; ok {
+			return m
+		}
+	}
+	return messages[defaultLanguage]
+}
+
+// parseAcceptLanguage returns the primary language subtags of an
+// Accept-Language header, most preferred first.
+func parseAcceptLanguage(header string) []string {
+	type weighted struct {
+		lang string
+		q    float64
+	}
+	var langs []weighted
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		lang := strings.ToLower(strings.TrimSpace(fields[0]))
+		if i := strings.IndexByte(lang, '-'); i >= 0 {
+			lang = lang[:i]
+		}
+		if lang == "" || lang == "*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > 0 {
+			langs = append(langs, weighted{lang, q})
+		}
+	}
+	sort.SliceStable(langs, func(i, j int) bool { return langs[i].q > langs[j].q })
+	res := make([]string, len(langs))
+	for i, l := range langs {
+		res[i] = l.lang
+	}
+	return res
+}
+
+// writeError aborts the request with err in the Fail envelope. The message is
+// localized according to the Accept-Language header; details carry the code,
+// the reason, for NOT_LEADER the leader and for a failed batch the failed
+// operations.
+func writeError(c *gin.Context, err error) {
+	e := toAPIError(err)
+	details := gin.H{"code": e.Code}
+	if e.Reason != "" {
+		details["reason"] = e.Reason
+	}
+	if e.Leader != "" {
+		details["leader"] = gin.H{"address": e.Leader}
+	}
+	if len(e.Failures) > 0 {
+		details["failures"] = e.Failures
+	}
+	c.AbortWithStatusJSON(errorCatalog[e.Code].httpStatus,
+		Fail(nil, e.Code.message(c.GetHeader("Accept-Language")), details))
+}
+
+// applyError writes the response of a command that applyCommand failed to
+// replicate or that the FSM rejected.
+func applyError(c *gin.Context, r *raft.Raft, err error) {
+	if e := toAPIError(err); e.Code == CodeNotLeader {
+		err = leaderError(r, e.Reason)
+	}
+	writeError(c, err)
+}
+
+// toStatus converts err into a gRPC status error with an ErrorInfo detail.
+// Errors that go away once the client reaches the (new) leader are marked
+// retriable. Status errors are returned unchanged.
+func toStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	e := toAPIError(err)
+	var st *status.Status
+	switch e.Code {
+	case CodeNotLeader, CodeNoLeader, CodeLeadershipLost, CodeUnavailable:
+		st = status.Convert(rafterrors.MarkRetriable(errors.New(e.Reason)))
+	default:
+		st = status.New(errorCatalog[e.Code].grpcCode, e.Reason)
+	}
+	return withErrorDetails(st, e, "").Err()
+}
+
+// withErrorDetails returns st with the ErrorInfo of e, a PreconditionFailure
+// listing the failed operations of a batch and, if acceptLanguage is set, a
+// LocalizedMessage in place of the details it already carries.
+func withErrorDetails(st *status.Status, e *APIError, acceptLanguage string) *status.Status {
+	res := status.New(st.Code(), st.Message())
+	var details []proto.Message
+	for _, d := range st.Details() {
+		switch d.(type) {
+		case *errdetails.ErrorInfo, *errdetails.LocalizedMessage:
+		default:
+			if m, ok := d.(proto.Message); ok {
+				details = append(details, m)
+			}
+		}
+	}
+	info := &errdetails.ErrorInfo{Reason: string(e.Code), Domain: errorDomain}
+	if e.Leader != "" {
+		info.Metadata = map[string]string{"leader": e.Leader}
+	}
+	details = append(details, info)
+	if len(e.Failures) > 0 {
+		pf := &errdetails.PreconditionFailure{}
+		for _, f := range e.Failures {
+			pf.Violations = append(pf.Violations, &errdetails.PreconditionFailure_Violation{
+				Type:        string(e.Code),
+				Subject:     fmt.Sprintf("ops[%d]", f.Index),
+				Description: f.Error,
+			})
+		}
+		details = append(details, pf)
+	}
+	if acceptLanguage != "" {
+		lang := defaultLanguage
+		if langs := parseAcceptLanguage(acceptLanguage); len(langs) > 0 {
+			if _, ok := errorCatalog[e.Code].messages[langs[0]]; ok {
+				lang = langs[0]
+			}
+		}
+		details = append(details, &errdetails.LocalizedMessage{Locale: lang, Message: e.Code.message(acceptLanguage)})
+	}
+	for _, d := range details {
+		if withDetails, err := res.WithDetails(d); err == nil {
+			res = withDetails
+		}
+	}
+	return res
+}
+
+// completeStatus completes an error of the KV service with the catalog
+// details: errors created without a code are classified by their gRPC code,
+// NOT_LEADER names the current leader or becomes NO_LEADER, and a
+// LocalizedMessage is added in the language of the accept-language metadata.
+func completeStatus(ctx context.Context, r *raft.Raft, err error) error {
+	st, ok := status.FromError(err)
+	if err == nil || !ok {
+		return err
+	}
+	var e *APIError
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok && info.GetDomain() == errorDomain {
+			e = &APIError{Code: ErrorCode(info.GetReason()), Leader: info.GetMetadata()["leader"]}
+		}
+	}
+	if e == nil {
+		code, ok := grpcErrorCodes[st.Code()]
+		if !ok {
+			return err
+		}
+		e = &APIError{Code: code}
+	}
+	if e.Code == CodeNotLeader && e.Leader == "" {
+		if e.Leader = string(r.Leader()); e.Leader == "" {
+			e.Code = CodeNoLeader
+		}
+	}
+	acceptLanguage := defaultLanguage
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get("accept-language")) > 0 {
+		acceptLanguage = strings.Join(md.Get("accept-language"), ",")
+	}
+	return withErrorDetails(st, e, acceptLanguage).Err()
+}
+
+// isKVMethod reports whether a gRPC method belongs to the KV service.
+func isKVMethod(fullMethod string) bool {
+	return strings.HasPrefix(fullMethod, "/drifterx.KV/")
+}
+
+// errorUnaryInterceptor completes the errors of unary KV calls, see
+// completeStatus.
+func errorUnaryInterceptor(r *raft.Raft) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		resp, err := handler(ctx, req)
+		if isKVMethod(info.FullMethod) {
+			err = completeStatus(ctx, r, err)
+		}
+		return resp, err
+	}
+}
+
+// errorStreamInterceptor completes the errors of streaming KV calls, see
+// completeStatus.
+func errorStreamInterceptor(r *raft.Raft) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		err := handler(srv, ss)
+		if isKVMethod(info.FullMethod) {
+			err = completeStatus(ss.Context(), r, err)
+		}
+		return err
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// expiryInterval is how often the leader looks for expired leases and keys.
+const expiryInterval = time.Second
+
+// RunExpiry periodically proposes commands that drop expired state. Only the
+// leader proposes them, so every replica applies the expiry at the same log
+// position instead of relying on its own clock.
+func RunExpiry(r *raft.Raft, x *DrifterX) {
+	ticker := time.NewTicker(expiryInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if r.State() != raft.Leader {
+			continue
+		}
+		now := time.Now()
+		for _, id := range x.expiredTransactions(now) {
+			_, _, err := applyCommand(context.Background(), r, &Command{
+				OpType: OpTrxExpire,
+				TrxID:  id,
+				Time:   now.UnixNano(),
+			})
+			if err != nil {
+				log.Printf("failed to expire transaction %d: %v", id, err)
+			}
+		}
+		for _, id := range x.expiredLeases(now) {
+			_, _, err := applyCommand(context.Background(), r, &Command{
+				OpType:  OpLeaseExpire,
+				LeaseID: id,
+				Time:    now.UnixNano(),
+			})
+			if err != nil {
+				log.Printf("failed to expire lease %d: %v", id, err)
+			}
+		}
+		for {
+			keys := x.expiredKeys(now, MaxKeyExpiriesPerCommand)
+			if len(keys) == 0 {
+				break
+			}
+			_, _, err := applyCommand(context.Background(), r, &Command{
+				OpType: OpKeyExpire,
+				Ops:    keyCommands(keys),
+				Time:   now.UnixNano(),
+			})
+			if err != nil {
+				log.Printf("failed to expire %d keys: %v", len(keys), err)
+				break
+			}
+			if len(keys) < MaxKeyExpiriesPerCommand {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	pb "github.com/Jille/raft-grpc-example/proto"
+	"github.com/gin-gonic/gin"
+	"github.com/hashicorp/raft"
+	"google.golang.org/grpc"
+)
+
+// 非 leader 节点收到写请求时的处理方式
+const (
+	// ForwardModeForward 通过内部 gRPC 连接把请求转发给 leader，并原样返回 leader 的响应
+	ForwardModeForward = "forward"
+	// ForwardModeRedirect 返回 421 NOT_LEADER 及当前 leader 的地址，由客户端自行重试
+	ForwardModeRedirect = "redirect"
+	// ForwardModeReject 直接拒绝请求，同样返回 NOT_LEADER
+	ForwardModeReject = "reject"
+)
+
+// forwardedHeader marks requests that already went through a follower, so
+// that a node which lost leadership in the meantime does not forward again.
+const forwardedHeader = "X-Drifterx-Forwarded"
+
+const forwardTimeout = 5 * time.Second
+
+// leaderForwarder sends HTTP requests to the current leader over gRPC. The
+// Forwarder service is registered on the server of the Raft transport, so the
+// leader is dialed at its Raft address, with the same options as the
+// transport.Manager. The connections are also used to reach other nodes, see
+// nodes.go, and are closed once their node left the cluster.
+//
+// The Forwarder service does not authenticate its callers itself. Unless
+// raft.listen keeps it off the public gRPC server or tls.ca_file makes every
+// caller present a certificate signed by that CA, anyone who reaches
+// grpc.listen could use it to write as the leader or to overwrite the
+// endpoints of a node. TLS without tls.ca_file only encrypts the connection.
+type leaderForwarder struct {
+	r    *raft.Raft
+	mode string
+
+	mtx   sync.Mutex
+	conns map[string]*grpc.ClientConn
+}
+
+func newLeaderForwarder(r *raft.Raft, mode string) (*leaderForwarder, error) {
+	switch mode {
+	case ForwardModeForward, ForwardModeRedirect, ForwardModeReject:
+	default:
+		return nil, fmt.Errorf("unsupported forward mode [%v]", mode)
+	}
+	return &leaderForwarder{
+		r:     r,
+		mode:  mode,
+		conns: map[string]*grpc.ClientConn{},
+	}, nil
+}
+
+// conn returns the cached connection to the node at addr.
+func (f *leaderForwarder) conn(addr string) (*grpc.ClientConn, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	conn, ok := f.conns[addr]
+	if !ok {
+		var err error
+		conn, err = grpc.Dial(addr, dialOptions...)
+		if err != nil {
+			return nil, err
+		}
+		f.conns[addr] = conn
+	}
+	return conn, nil
+}
+
+// closeConns closes and forgets the cached connections to the addresses for
+// which drop returns true.
+func (f *leaderForwarder) closeConns(drop func(addr string) bool) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	for addr, conn := range f.conns {
+		if drop(addr) {
+			conn.Close()
+			delete(f.conns, addr)
+		}
+	}
+}
+
+func (f *leaderForwarder) client(leader raft.ServerAddress) (pb.ForwarderClient, error) {
+	conn, err := f.conn(string(leader))
+	if err != nil {
+		return nil, err
+	}
+	return pb.NewForwarderClient(conn), nil
+}
+
+// Middleware lets the request through on the leader and handles it according
+// to the configured mode everywhere else.
+func (f *leaderForwarder) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if f.r.State() == raft.Leader {
+			c.Next()
+			return
+		}
+		leader := f.r.Leader()
+		switch {
+		case leader == "":
+			// 不是leader 且当前无leader
+			writeError(c, newAPIError(CodeNoLeader, "no leader running"))
+		case f.mode == ForwardModeReject:
+			writeError(c, &APIError{Code: CodeNotLeader, Reason: "requested node is not leader and forwarding is disabled", Leader: string(leader)})
+		case f.mode == ForwardModeRedirect || c.GetHeader(forwardedHeader) != "":
+			writeError(c, &APIError{Code: CodeNotLeader, Reason: "requested node is not leader", Leader: string(leader)})
+		default:
+			f.forward(c, leader)
+		}
+	}
+}
+
+func (f *leaderForwarder) forward(c *gin.Context, leader raft.ServerAddress) {
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		writeError(c, newAPIError(CodeInvalidArgument, err.Error()))
+		return
+	}
+	req := &pb.ForwardRequest{
+		Method: c.Request.Method,
+		Path:   c.Request.URL.RequestURI(),
+		Header: map[string]string{},
+		Body:   body,
+	}
+	for k := range c.Request.Header {
+		req.Header[k] = c.Request.Header.Get(k)
+	}
+	client, err := f.client(leader)
+	if err != nil {
+		writeError(c, &APIError{Code: CodeForwardFailed, Reason: fmt.Sprintf("unable to reach leader: %v", err), Leader: string(leader)})
+		return
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), forwardTimeout)
+	defer cancel()
+	resp, err := client.Forward(ctx, req)
+	if err != nil {
+		writeError(c, &APIError{Code: CodeForwardFailed, Reason: fmt.Sprintf("forwarding to leader failed: %v", err), Leader: string(leader)})
+		return
+	}
+	for k, v := range resp.GetHeader() {
+		c.Header(k, v)
+	}
+	c.Status(int(resp.GetStatus()))
+	c.Writer.Write(resp.GetBody())
+	c.Abort()
+}
+
+// forwarderServer executes forwarded requests against the local HTTP router
+// and records the endpoints followers advertise.
+type forwarderServer struct {
+	handler http.Handler
+	raft    *raft.Raft
+}
+
+func (s *forwarderServer) Forward(ctx context.Context, req *pb.ForwardRequest) (*pb.ForwardResponse, error) {
+	httpReq, err := http.NewRequest(req.GetMethod(), req.GetPath(), bytes.NewReader(req.GetBody()))
+	if err != nil {
+		return nil, err
+	}
+	httpReq = httpReq.WithContext(ctx)
+	for k, v := range req.GetHeader() {
+		httpReq.Header.Set(k, v)
+	}
+	httpReq.Header.Set(forwardedHeader, "1")
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, httpReq)
+	resp := &pb.ForwardResponse{
+		Status: int32(rec.Code),
+		Header: map[string]string{},
+		Body:   rec.Body.Bytes(),
+	}
+	for k := range rec.Header() {
+		resp.Header[k] = rec.Header().Get(k)
+	}
+	return resp, nil
+}
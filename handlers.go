@@ -1,276 +1,255 @@
 package main
 
 import (
-	"fmt"
-	"github.com/LaJunkai/drifterdb"
+	"context"
 	"github.com/gin-gonic/gin"
 	"github.com/hashicorp/raft"
 	"time"
 )
 
-func MachinesHandler(db drifterdb.BaseDB, r *raft.Raft) gin.HandlerFunc {
+// MachinesHandler lists the members of the cluster with their endpoints, role
+// and health, see listNodes.
+func MachinesHandler(x *DrifterX, r *raft.Raft, fwd *leaderForwarder, self raft.ServerID) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		servers := r.GetConfiguration().Configuration().Servers
-		c.JSON(200, Success(servers, "", nil))
+		nodes, err := listNodes(c.Request.Context(), x, r, fwd, self)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(200, Success(nodes, "", nil))
 	}
 }
 
-func PutHandler(db drifterdb.BaseDB, r *raft.Raft) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		// 判断leader状态
-		if r.State().String() == "Leader" {
-			param := ReqBody{}
-			err := c.ShouldBindJSON(&param)
-			if err != nil {
-				c.JSON(401, Fail(nil, "参数格式错误", nil))
-				return
-			}
-			convertedValue, err := ConvertToBytes(param.Type, param.Value)
-			if err != nil {
-				c.JSON(401, Fail(nil, err.Error(), nil))
-				return
-			}
-			commandBytes, err := (&Command{
-				OpType: OpPut,
-				Key:    []byte(param.Key),
-				Value:  convertedValue,
-				TrxID:  param.TrxID,
-			}).ToBytes()
-			if err != nil {
-				c.JSON(500, Success(nil, "unknown error occurred during generating command for raft sync", nil))
-			}
-			r.Apply(commandBytes, time.Second)
-			c.JSON(200, Success(nil, "", nil))
-		} else if r.Leader() != "" {
-			c.JSON(
-				300,
-				Fail(
-					r.Leader(),
-					fmt.Sprintf("requested node is not leader, current leader is [%v]", r.Leader()),
-					nil,
-				),
-			)
-		} else {
-			// 不是leader 且当前无leader
-			c.JSON(300,
-				Fail(nil, "no leader running, please waiting for the selection.", nil))
-		}
-
+// readBarrier waits until the node may serve a read with the requested
+// consistency, within the deadline of the request. On failure it writes the
+// error response and returns false.
+func readBarrier(c *gin.Context, x *DrifterX, r *raft.Raft, consistency string) (uint64, bool) {
+	index, err := x.waitForRead(c.Request.Context(), r, consistency)
+	if err == nil {
+		return index, true
+	}
+	if err == errNotLeader {
+		err = leaderError(r, err.Error())
 	}
+	writeError(c, err)
+	return 0, false
 }
 
-func GetHandler(db drifterdb.BaseDB, r *raft.Raft) gin.HandlerFunc {
+func GetHandler(x *DrifterX, r *raft.Raft) gin.HandlerFunc {
+	db := x.db
 	return func(c *gin.Context) {
 		param := ReqBody{}
 		err := c.ShouldBindJSON(&param)
 		if err != nil {
-			c.JSON(401, Fail(nil, "参数格式错误", nil))
+			writeError(c, newAPIError(CodeInvalidArgument, err.Error()))
+			return
+		}
+		if err := checkType(param.Type); err != nil {
+			writeError(c, newAPIError(CodeInvalidArgument, err.Error()))
+			return
+		}
+		if err := checkPointers(param.Fields); err != nil {
+			writeError(c, newAPIError(CodeInvalidArgument, err.Error()))
+			return
+		}
+		appliedIndex, ok := readBarrier(c, x, r, param.Consistency)
+		if !ok {
 			return
 		}
-		var v []byte
-		if param.TrxID == 0 { // 未指定事务，开启新事务完成操作
-			v = db.Get([]byte(param.Key))
-		} else {
-			if trx := db.MapTransaction(param.TrxID); trx != nil {
-				v = db.Get([]byte(param.Key))
+		var reader kvReader = db
+		if param.TrxID != 0 {
+			// 事务内的读取能看到本事务尚未提交的写入
+			if trx := x.transaction(param.TrxID); trx != nil {
+				reader = trx
 			} else {
-				c.JSON(500, Fail(nil, "未找到指定事务", nil))
+				writeError(c, errTrxNotFound)
+				return
 			}
 		}
-		if converter, ok := ConverterMap[param.Type]; ok {
-			c.JSON(200, Success(
-				gin.H{
-					"key":   param.Key,
-					"value": converter(v),
-				}, "", nil,
-			))
-		} else {
-			c.JSON(401, Fail(nil, fmt.Sprintf("requested type [%v] is not supported", param.Type), nil))
+		// 已过期但尚未被删除的 key 视为不存在
+		e, err := getLiveEntry(reader, []byte(param.Key), time.Now().UnixNano())
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		if e == nil {
+			// 不存在的 key 的值为 null，元数据均为 0
+			c.JSON(200, Success(&KV{Key: param.Key}, "", gin.H{"applied_index": appliedIndex}))
+			return
+		}
+		kv, err := NewKV(param.Key, e, param.Type)
+		if err == nil {
+			err = kv.Project(e, param.Fields)
+		}
+		if err != nil {
+			writeError(c, decodeError(err))
+			return
 		}
+		c.JSON(200, Success(kv, "", gin.H{"applied_index": appliedIndex}))
 	}
 }
 
-func StartTransactionHandler(db drifterdb.BaseDB, r *raft.Raft) gin.HandlerFunc {
+// TransactionsHandler lists the open transactions known to this node.
+func TransactionsHandler(x *DrifterX) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if r.State().String() == "Leader" {
-			commandBytes, err := (&Command{
-				OpType: OpTrx,
-				Key:    []byte(""),
-				Value:  []byte(""),
-				TrxID:  0,
-			}).ToBytes()
-			if err != nil {
-				c.JSON(500, Success(nil, "unknown error occurred during generating command for raft sync", nil))
-			}
-			newTrxChan := r.Apply(commandBytes, time.Second)
-			newTrx := newTrxChan.Response()
-			c.JSON(200, Success(gin.H{"trx_id": newTrx.(*drifterdb.Transaction).TrxID()}, "", nil))
-		} else if r.Leader() != "" {
-			c.JSON(
-				300,
-				Fail(
-					r.Leader(),
-					fmt.Sprintf("requested node is not leader, current leader is [%v]", r.Leader()),
-					nil,
-				),
-			)
-		} else {
-			// 不是leader 且当前无leader
-			c.JSON(300,
-				Fail(nil, "no leader running, please waiting for the selection.", nil))
-		}
+		c.JSON(200, Success(x.Transactions(time.Now()), "", nil))
 	}
 }
 
-func CommitTransactionHandler(db drifterdb.BaseDB, r *raft.Raft) gin.HandlerFunc {
+// LeasesHandler lists the leases known to this node with their keys.
+func LeasesHandler(x *DrifterX) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if r.State().String() == "Leader" {
-			param := TrxParams{}
-			err := c.ShouldBindJSON(&param)
-			if err != nil {
-				c.JSON(401, Fail(nil, "参数格式错误", nil))
-				return
-			}
-			commandBytes, err := (&Command{
-				OpType: OpCmt,
-				Key:    []byte(""),
-				Value:  []byte(""),
-				TrxID:  param.TrxID,
-			}).ToBytes()
-			if err != nil {
-				c.JSON(500, Success(nil, "unknown error occurred during generating command for raft sync", nil))
-			}
-			r.Apply(commandBytes, time.Second)
-			c.JSON(200, Success(true, "", nil))
-		} else if r.Leader() != "" {
-			c.JSON(
-				300,
-				Fail(
-					r.Leader(),
-					fmt.Sprintf("requested node is not leader, current leader is [%v]", r.Leader()),
-					nil,
-				),
-			)
-		} else {
-			// 不是leader 且当前无leader
-			c.JSON(300,
-				Fail(nil, "no leader running, please waiting for the selection.", nil))
-		}
+		c.JSON(200, Success(x.Leases(), "", nil))
 	}
 }
 
-func RollbackTransactionHandler(db drifterdb.BaseDB, r *raft.Raft) gin.HandlerFunc {
+func RangeHandler(x *DrifterX, r *raft.Raft) gin.HandlerFunc {
+	db := x.db
 	return func(c *gin.Context) {
-		if r.State().String() == "Leader" {
-			param := TrxParams{}
-			err := c.ShouldBindJSON(&param)
-			if err != nil {
-				c.JSON(401, Fail(nil, "参数格式错误", nil))
+		param := RangeParams{}
+		err := c.ShouldBindJSON(&param)
+		if err != nil {
+			writeError(c, newAPIError(CodeInvalidArgument, err.Error()))
+			return
+		}
+		appliedIndex, ok := readBarrier(c, x, r, param.Consistency)
+		if !ok {
+			return
+		}
+		var reader rangeReader = db
+		if param.TrxID != 0 {
+			trx := x.transaction(param.TrxID)
+			if trx == nil {
+				writeError(c, errTrxNotFound)
 				return
 			}
-			commandBytes, err := (&Command{
-				OpType: OpRol,
-				Key:    []byte(""),
-				Value:  []byte(""),
-				TrxID:  param.TrxID,
-			}).ToBytes()
+			reader = trx
+		}
+		if err := checkType(param.Type); err != nil {
+			writeError(c, newAPIError(CodeInvalidArgument, err.Error()))
+			return
+		}
+		if err := checkPointers(param.Fields); err != nil {
+			writeError(c, newAPIError(CodeInvalidArgument, err.Error()))
+			return
+		}
+		page, err := scanRange(reader, RangeQuery{
+			StartKey:  []byte(param.StartKey),
+			EndKey:    []byte(param.EndKey),
+			Prefix:    []byte(param.Prefix),
+			Reverse:   param.Reverse,
+			Limit:     param.Limit,
+			PageToken: param.Token,
+			Now:       time.Now().UnixNano(),
+		})
+		if err != nil {
+			writeError(c, newAPIError(CodeInvalidArgument, err.Error()))
+			return
+		}
+		res := make([]*KV, 0, len(page.Items))
+		for _, item := range page.Items {
+			kv, err := NewKV(string(item.Key), item.Entry, param.Type)
+			if err == nil {
+				err = kv.Project(item.Entry, param.Fields)
+			}
 			if err != nil {
-				c.JSON(500, Success(nil, "unknown error occurred during generating command for raft sync", nil))
+				writeError(c, decodeError(err))
+				return
 			}
-			r.Apply(commandBytes, time.Second)
-			c.JSON(200, Success(true, "", nil))
-		} else if r.Leader() != "" {
-			c.JSON(
-				300,
-				Fail(
-					r.Leader(),
-					fmt.Sprintf("requested node is not leader, current leader is [%v]", r.Leader()),
-					nil,
-				),
-			)
-		} else {
-			// 不是leader 且当前无leader
-			c.JSON(300,
-				Fail(nil, "no leader running, please waiting for the selection.", nil))
+			res = append(res, kv)
 		}
+		c.JSON(200, Success(
+			gin.H{
+				"kvs":        res,
+				"next_token": page.NextPageToken,
+			}, "", gin.H{"applied_index": appliedIndex},
+		))
 	}
 }
 
-func DeleteHandler(db drifterdb.BaseDB, r *raft.Raft) gin.HandlerFunc {
+// LeaderHandler returns the current leader like MachinesHandler lists it.
+func LeaderHandler(x *DrifterX, r *raft.Raft, fwd *leaderForwarder, self raft.ServerID) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if r.State().String() == "Leader" {
-			param := ReqBody{}
-			err := c.ShouldBindJSON(&param)
-			if err != nil {
-				c.JSON(401, Fail(nil, "参数格式错误", nil))
+		nodes, err := listNodes(c.Request.Context(), x, r, fwd, self)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		for _, n := range nodes {
+			if n.Role == RoleLeader {
+				c.JSON(200, Success(n, "", nil))
 				return
 			}
-
-			commandBytes, err := (&Command{
-				OpType: OpDel,
-				Key:    []byte(param.Key),
-				Value:  []byte(""),
-				TrxID:  param.TrxID,
-			}).ToBytes()
-			if err != nil {
-				c.JSON(500, Success(nil, "unknown error occurred during generating command for raft sync", nil))
-			}
-			r.Apply(commandBytes, time.Second)
-			c.JSON(200, Success(nil, "", nil))
-		} else if r.Leader() != "" {
-			c.JSON(
-				300,
-				Fail(
-					r.Leader(),
-					fmt.Sprintf("requested node is not leader, current leader is [%v]", r.Leader()),
-					nil,
-				),
-			)
-		} else {
-			// 不是leader 且当前无leader
-			c.JSON(300,
-				Fail(nil, "no leader running, please waiting for the selection.", nil))
 		}
+		writeError(c, newAPIError(CodeNoLeader, "no leader running"))
 	}
 }
 
-func RangeHandler(db drifterdb.BaseDB, r *raft.Raft) gin.HandlerFunc {
+// watchHeartbeat is how often an idle watch stream sends a comment line, so
+// proxies do not close it.
+const watchHeartbeat = 15 * time.Second
+
+// WatchHandler streams the changes of a key or prefix as Server-Sent Events.
+// Each event is named put or delete and carries the key, its metadata and the
+// revision of the change. A watcher whose revision is no longer available
+// receives a compacted event and the stream ends.
+func WatchHandler(x *DrifterX) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		param := RangeParams{}
-		err := c.ShouldBindJSON(&param)
-		if err != nil {
-			c.JSON(401, Fail(nil, "参数格式错误", nil))
+		param := WatchParams{}
+		if err := c.ShouldBindQuery(&param); err != nil {
+			writeError(c, newAPIError(CodeInvalidArgument, err.Error()))
 			return
 		}
-		var v []*drifterdb.Element
-		if param.TrxID == 0 { // 未指定事务，开启新事务完成操作
-			v = db.Range([]byte(param.StartKey), []byte(param.EndKey), param.Offset, param.Count)
-		} else {
-			if trx := db.MapTransaction(param.TrxID); trx != nil {
-				v = db.Range([]byte(param.StartKey), []byte(param.EndKey), param.Offset, param.Count)
-			} else {
-				c.JSON(500, Fail(nil, "未找到指定事务", nil))
-			}
+		if err := checkType(param.Type); err != nil {
+			writeError(c, newAPIError(CodeInvalidArgument, err.Error()))
+			return
 		}
-		if converter, ok := ConverterMap[param.Type]; ok {
-			res := make([]*KV, len(v))
-			for _, eachElement := range v {
-				res = append(res, &KV{
-					Key:   string(eachElement.Key().([]byte)),
-					Value: converter(eachElement.Value()),
-				})
+		filter := WatchFilter{Key: []byte(param.Key), Prefix: param.Prefix}
+		rev := x.watch.startRevision(param.StartRevision)
+		ctx := c.Request.Context()
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Content-Type", "text/event-stream")
+		c.Writer.WriteHeader(200)
+		c.Writer.Flush()
+		for {
+			waitCtx, cancel := context.WithTimeout(ctx, watchHeartbeat)
+			events, next, err := x.watch.wait(waitCtx, rev, filter)
+			cancel()
+			rev = next
+			if compacted, ok := err.(*CompactedError); ok {
+				c.SSEvent("compacted", gin.H{"compact_revision": compacted.Revision})
+				c.Writer.Flush()
+				return
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				c.Writer.WriteString(": keepalive\n\n")
+				c.Writer.Flush()
+				continue
+			}
+			for _, ev := range events {
+				we := WatchEvent{KV: KV{Key: string(ev.Key), ModRevision: ev.Revision}, Revision: ev.Revision}
+				if ev.Entry != nil {
+					kv, err := NewKV(string(ev.Key), ev.Entry, param.Type)
+					if err != nil {
+						// 无法解码的值会终止本次 watch，由客户端指定类型后重新订阅
+						e := decodeError(err)
+						c.SSEvent("error", gin.H{
+							"code":     e.Code,
+							"message":  e.Code.message(c.GetHeader("Accept-Language")),
+							"reason":   e.Reason,
+							"revision": ev.Revision,
+						})
+						c.Writer.Flush()
+						return
+					}
+					we.KV = *kv
+				}
+				c.SSEvent(ev.Type, we)
 			}
-			c.JSON(200, Success(
-				res, "", nil,
-			))
-		} else {
-			c.JSON(401, Fail(nil, fmt.Sprintf("requested type [%v] is not supported", param.Type), nil))
+			c.Writer.Flush()
 		}
 	}
 }
-
-func LeaderHandler(db drifterdb.BaseDB, r *raft.Raft) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		c.JSON(200, Success(r.Leader(), "", nil))
-	}
-}
\ No newline at end of file
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var (
+	errNotInteger   = errors.New("stored value is not an int")
+	errIncrOverflow = errors.New("increment overflows int64")
+)
+
+// OutOfBoundsError is returned when an increment would leave the bounds of
+// the command. The counter is left unchanged.
+type OutOfBoundsError struct {
+	Value int64
+}
+
+func (e *OutOfBoundsError) Error() string {
+	return fmt.Sprintf("result %d is out of bounds", e.Value)
+}
+
+// incrementedValue returns the value an OpIncr command produces from current.
+// A missing key starts at c.Initial.
+func incrementedValue(current *entry, c *Command) (int64, error) {
+	v := c.Initial
+	if current != nil {
+		// 未记录类型的旧值只能按长度判断
+		if (current.Type != "" && current.Type != "int") || len(current.Value) != 8 {
+			return 0, errNotInteger
+		}
+		v = int64(binary.BigEndian.Uint64(current.Value))
+	}
+	res := v + c.Delta
+	if (c.Delta > 0 && res < v) || (c.Delta < 0 && res > v) {
+		return 0, errIncrOverflow
+	}
+	if (c.Min != nil && res < *c.Min) || (c.Max != nil && res > *c.Max) {
+		return 0, &OutOfBoundsError{Value: res}
+	}
+	return res, nil
+}
+
+// applyIncr performs an OpIncr command on w and returns the new value.
+func applyIncr(w kvWriter, c *Command) (int64, error) {
+	current, err := getLiveEntry(w, c.Key, c.Time)
+	if err != nil {
+		return 0, err
+	}
+	if err := checkCondition(current, c); err != nil {
+		return 0, err
+	}
+	v, err := incrementedValue(current, c)
+	if err != nil {
+		return 0, err
+	}
+	return v, writeUpdatedEntry(w, current, c, encodeInt(v), "int")
+}
+
+// applyIncrCommand applies an OpIncr command at index and returns the new
+// value or an error.
+func (x *DrifterX) applyIncrCommand(index uint64, c *Command) interface{} {
+	return x.applyUpdateCommand(index, c, func(w kvWriter) (interface{}, error) {
+		v, err := applyIncr(w, c)
+		return v, err
+	})
+}
+
+func encodeInt(v int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(v))
+	return b
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// JSON 文档操作在状态机中执行：读取当前文档，修改后重新编码写回。
+// 解码时保留数字的原始文本，encoding/json 按 key 排序编码对象，
+// 因此所有副本写入的字节完全相同。
+
+var errNotJSONDocument = errors.New("stored value is not a json document")
+
+// JSONPathError is returned when a JSON pointer does not address a location
+// the operation can be applied to. The document is left unchanged.
+type JSONPathError struct {
+	Path   string
+	Reason string
+}
+
+func (e *JSONPathError) Error() string {
+	return fmt.Sprintf("json path %q: %s", e.Path, e.Reason)
+}
+
+var pointerUnescaper = strings.NewReplacer("~1", "/", "~0", "~")
+
+// parsePointer splits a JSON pointer (RFC 6901) into its unescaped reference
+// tokens. The empty pointer addresses the whole document.
+func parsePointer(p string) ([]string, error) {
+	if p == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(p, "/") {
+		return nil, &JSONPathError{Path: p, Reason: "must be empty or start with /"}
+	}
+	tokens := strings.Split(p[1:], "/")
+	for i, t := range tokens {
+		for j := 0; j < len(t); j++ {
+			if t[j] == '~' && (j+1 == len(t) || (t[j+1] != '0' && t[j+1] != '1')) {
+				return nil, &JSONPathError{Path: p, Reason: "~ must be followed by 0 or 1"}
+			}
+		}
+		tokens[i] = pointerUnescaper.Replace(t)
+	}
+	return tokens, nil
+}
+
+func decodeDocument(b []byte) (interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	if d.More() {
+		return nil, errors.New("trailing data after json value")
+	}
+	return v, nil
+}
+
+// patchedDocument returns the document and type a JSON document command
+// produces from current. A missing key is an empty (null) document.
+func patchedDocument(current *entry, c *Command) ([]byte, string, error) {
+	var doc interface{}
+	t := "json"
+	if current != nil {
+		if current.Type != "" && current.Type != "json" && current.Type != "list" {
+			return nil, "", errNotJSONDocument
+		}
+		var err error
+		if doc, err = decodeDocument(current.Value); err != nil {
+			return nil, "", errNotJSONDocument
+		}
+		t = current.Type
+	}
+	tokens, err := parsePointer(c.Path)
+	if err != nil {
+		return nil, "", err
+	}
+	var value interface{}
+	if c.OpType != OpJSONRemove {
+		if value, err = decodeDocument(c.Value); err != nil {
+			return nil, "", fmt.Errorf("invalid json value: %v", err)
+		}
+	}
+	var update func(v interface{}, exists bool) (interface{}, bool, error)
+	switch c.OpType {
+	case OpJSONMerge:
+		update = func(v interface{}, exists bool) (interface{}, bool, error) {
+			return mergePatch(v, value), true, nil
+		}
+	case OpJSONSet:
+		update = func(v interface{}, exists bool) (interface{}, bool, error) {
+			return value, true, nil
+		}
+	case OpJSONRemove:
+		update = func(v interface{}, exists bool) (interface{}, bool, error) {
+			if !exists {
+				return nil, false, &JSONPathError{Path: c.Path, Reason: "not found"}
+			}
+			return nil, false, nil
+		}
+	case OpJSONAppend:
+		update = func(v interface{}, exists bool) (interface{}, bool, error) {
+			if !exists || v == nil {
+				// 不存在的位置视为空数组
+				return []interface{}{value}, true, nil
+			}
+			arr, ok := v.([]interface{})
+			if !ok {
+				return nil, false, &JSONPathError{Path: c.Path, Reason: "not an array"}
+			}
+			return append(arr, value), true, nil
+		}
+	default:
+		return nil, "", fmt.Errorf("operation type %d is not a json document operation", c.OpType)
+	}
+	if doc, err = updatePointer(doc, current != nil, tokens, c.Path, update); err != nil {
+		return nil, "", err
+	}
+	if _, ok := doc.([]interface{}); !ok || t == "" {
+		// 根不再是数组的 list 变为 json，旧版本写入的值也从此记录类型
+		t = "json"
+	}
+	b, err := json.Marshal(doc)
+	return b, t, err
+}
+
+// updatePointer replaces the location addressed by tokens within doc with the
+// result of update, which receives the current value at the location and
+// whether it exists. The location is removed if update does not keep a value.
+// Only the last token may address a location that does not exist.
+func updatePointer(doc interface{}, exists bool, tokens []string, path string, update func(v interface{}, exists bool) (interface{}, bool, error)) (interface{}, error) {
+	if len(tokens) == 0 {
+		v, keep, err := update(doc, exists)
+		if err == nil && !keep {
+			err = &JSONPathError{Path: path, Reason: "cannot remove the whole document"}
+		}
+		return v, err
+	}
+	if !exists {
+		return nil, &JSONPathError{Path: path, Reason: "not found"}
+	}
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		child, ok := node[tokens[0]]
+		if len(tokens) > 1 {
+			v, err := updatePointer(child, ok, tokens[1:], path, update)
+			if err != nil {
+				return nil, err
+			}
+			node[tokens[0]] = v
+			return node, nil
+		}
+		v, keep, err := update(child, ok)
+		if err != nil {
+			return nil, err
+		}
+		if keep {
+			node[tokens[0]] = v
+		} else {
+			delete(node, tokens[0])
+		}
+		return node, nil
+	case []interface{}:
+		i, err := arrayIndex(tokens[0], len(node), path)
+		if err != nil {
+			return nil, err
+		}
+		ok := i < len(node)
+		var child interface{}
+		if ok {
+			child = node[i]
+		}
+		if len(tokens) > 1 {
+			v, err := updatePointer(child, ok, tokens[1:], path, update)
+			if err != nil {
+				return nil, err
+			}
+			node[i] = v
+			return node, nil
+		}
+		v, keep, err := update(child, ok)
+		switch {
+		case err != nil:
+			return nil, err
+		case keep && ok:
+			node[i] = v
+		case keep:
+			node = append(node, v)
+		default:
+			node = append(node[:i], node[i+1:]...)
+		}
+		return node, nil
+	default:
+		return nil, &JSONPathError{Path: path, Reason: "parent is not an object or array"}
+	}
+}
+
+// arrayIndex parses an array reference token. "-" addresses the element after
+// the last one.
+func arrayIndex(token string, n int, path string) (int, error) {
+	if token == "-" {
+		return n, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, &JSONPathError{Path: path, Reason: fmt.Sprintf("invalid array index %q", token)}
+	}
+	if i > n {
+		return 0, &JSONPathError{Path: path, Reason: "array index out of range"}
+	}
+	return i, nil
+}
+
+// mergePatch applies patch to target as described by RFC 7396.
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+	return t
+}
+
+// lookupPointer returns the value addressed by tokens within doc.
+func lookupPointer(doc interface{}, tokens []string) (interface{}, bool) {
+	for _, t := range tokens {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			v, ok := node[t]
+			if !ok {
+				return nil, false
+			}
+			doc = v
+		case []interface{}:
+			i, err := arrayIndex(t, len(node), "")
+			if err != nil || i >= len(node) {
+				return nil, false
+			}
+			doc = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// projectDocument selects fields, given as JSON pointers, from the json or
+// list value of e. The result maps every field found to its value.
+func projectDocument(e *entry, t string, fields []string) (map[string]interface{}, error) {
+	if e.Type != "" {
+		t = e.Type
+	}
+	if t != "json" && t != "list" {
+		return nil, errors.New("fields can only be selected from json and list values")
+	}
+	doc, err := decodeDocument(e.Value)
+	if err != nil {
+		return nil, errNotJSONDocument
+	}
+	res := make(map[string]interface{}, len(fields))
+	for _, f := range fields {
+		tokens, err := parsePointer(f)
+		if err != nil {
+			return nil, err
+		}
+		if v, ok := lookupPointer(doc, tokens); ok {
+			res[f] = v
+		}
+	}
+	return res, nil
+}
+
+// checkPointers validates the JSON pointers of a request.
+func checkPointers(pointers []string) error {
+	for _, p := range pointers {
+		if _, err := parsePointer(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyJSON performs a JSON document command on w and returns the resulting
+// document.
+func applyJSON(w kvWriter, c *Command) (json.RawMessage, error) {
+	current, err := getLiveEntry(w, c.Key, c.Time)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCondition(current, c); err != nil {
+		return nil, err
+	}
+	doc, t, err := patchedDocument(current, c)
+	if err != nil {
+		return nil, err
+	}
+	return doc, writeUpdatedEntry(w, current, c, doc, t)
+}
+
+// applyJSONCommand applies a JSON document command at index and returns the
+// resulting document or an error.
+func (x *DrifterX) applyJSONCommand(index uint64, c *Command) interface{} {
+	return x.applyUpdateCommand(index, c, func(w kvWriter) (interface{}, error) {
+		doc, err := applyJSON(w, c)
+		return doc, err
+	})
+}
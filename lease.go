@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	// DefaultLeaseTTL is the TTL of a lease whose client did not ask for one.
+	DefaultLeaseTTL = time.Minute
+	// MaxLeaseTTL caps the TTL a client may request.
+	MaxLeaseTTL = 24 * time.Hour
+)
+
+var (
+	errLeaseNotFound      = errors.New("lease not found")
+	errLeaseInTransaction = errors.New("keys cannot be attached to a lease inside a transaction")
+)
+
+// lease is the FSM-side state of a lease.
+//
+// 租约 ID 与事务 ID 一样是授予租约的那条日志的 index。挂在租约上的 key 在值的信封中
+// 记录租约 ID，keys 是由此得到的内存索引，快照恢复时从数据中重建。
+// 所有时间同样来自命令中 leader 写入的 Time。
+type lease struct {
+	grantedAt int64 // unix nano
+	deadline  int64 // unix nano
+	ttl       time.Duration
+	keys      map[string]struct{}
+}
+
+// LeaseInfo describes a lease, see GET /db/leases.
+type LeaseInfo struct {
+	ID        uint64    `json:"id"`
+	GrantedAt time.Time `json:"granted_at"`
+	Deadline  time.Time `json:"deadline"`
+	TTL       float64   `json:"ttl"` // 秒
+	Keys      []string  `json:"keys"`
+}
+
+func normalizeLeaseTTL(ttl time.Duration) time.Duration {
+	if ttl <= 0 {
+		return DefaultLeaseTTL
+	}
+	if ttl > MaxLeaseTTL {
+		return MaxLeaseTTL
+	}
+	return ttl
+}
+
+// grantLease creates the lease of the OpLeaseGrant command at index.
+func (x *DrifterX) grantLease(index uint64, c *Command) *LeaseInfo {
+	ttl := normalizeLeaseTTL(time.Duration(c.TTL))
+	l := &lease{
+		grantedAt: c.Time,
+		deadline:  c.Time + int64(ttl),
+		ttl:       ttl,
+		keys:      map[string]struct{}{},
+	}
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	x.leases[index] = l
+	info := l.info(index)
+	return &info
+}
+
+// keepAliveLease renews a lease and returns its info.
+func (x *DrifterX) keepAliveLease(c *Command) (*LeaseInfo, error) {
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	l, ok := x.leases[c.LeaseID]
+	if !ok {
+		return nil, errLeaseNotFound
+	}
+	if l.deadline < c.Time+int64(l.ttl) {
+		l.deadline = c.Time + int64(l.ttl)
+	}
+	info := l.info(c.LeaseID)
+	return &info, nil
+}
+
+// revokeLease deletes the lease and every key attached to it at revision rev.
+func (x *DrifterX) revokeLease(id uint64, rev uint64) error {
+	x.mtx.Lock()
+	l, ok := x.leases[id]
+	delete(x.leases, id)
+	x.mtx.Unlock()
+	if !ok {
+		return errLeaseNotFound
+	}
+	keys := make([]string, 0, len(l.keys))
+	for key := range l.keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	deleted := make([][]byte, len(keys))
+	for i, key := range keys {
+		deleted[i] = []byte(key)
+	}
+	return x.publishChanges(rev, deleted, func() error {
+		for _, key := range deleted {
+			if err := x.db.Delete(key); err != nil {
+				return fmt.Errorf("deleting key %q of lease %d: %v", key, id, err)
+			}
+		}
+		return nil
+	})
+}
+
+// expireLease revokes a lease whose TTL ran out before c.Time. A lease renewed
+// after the leader decided to expire it is left alone.
+func (x *DrifterX) expireLease(rev uint64, c *Command) bool {
+	x.mtx.Lock()
+	l, ok := x.leases[c.LeaseID]
+	expired := ok && l.deadline <= c.Time
+	x.mtx.Unlock()
+	if expired {
+		x.revokeLease(c.LeaseID, rev)
+	}
+	return expired
+}
+
+// checkLease verifies that a write in transaction trxID may attach its key to
+// lease id.
+func (x *DrifterX) checkLease(id, trxID uint64) error {
+	if id == 0 {
+		return nil
+	}
+	if trxID != 0 {
+		return errLeaseInTransaction
+	}
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	if _, ok := x.leases[id]; !ok {
+		return errLeaseNotFound
+	}
+	return nil
+}
+
+// trackLease updates the lease index after key was committed as e, or
+// deleted when e is nil.
+func (x *DrifterX) trackLease(key []byte, e *entry) {
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	if id, ok := x.keyLeases[string(key)]; ok {
+		if l, ok := x.leases[id]; ok {
+			delete(l.keys, string(key))
+		}
+		delete(x.keyLeases, string(key))
+	}
+	if e == nil || e.Lease == 0 {
+		return
+	}
+	if l, ok := x.leases[e.Lease]; ok {
+		l.keys[string(key)] = struct{}{}
+		x.keyLeases[string(key)] = e.Lease
+	}
+}
+
+// Leases lists the leases ordered by id.
+func (x *DrifterX) Leases() []LeaseInfo {
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	res := make([]LeaseInfo, 0, len(x.leases))
+	for id, l := range x.leases {
+		res = append(res, l.info(id))
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res
+}
+
+// expiredLeases returns the ids of leases whose TTL ran out at now.
+func (x *DrifterX) expiredLeases(now time.Time) []uint64 {
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	var ids []uint64
+	for id, l := range x.leases {
+		if l.deadline <= now.UnixNano() {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func (l *lease) info(id uint64) LeaseInfo {
+	keys := make([]string, 0, len(l.keys))
+	for key := range l.keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return LeaseInfo{
+		ID:        id,
+		GrantedAt: time.Unix(0, l.grantedAt),
+		Deadline:  time.Unix(0, l.deadline),
+		TTL:       l.ttl.Seconds(),
+		Keys:      keys,
+	}
+}
+
+// snapshotLeases encodes every lease as a snapshot record, reusing the
+// command encoding like snapshotTransactions. The attached keys are not
+// recorded; they are found again from the restored data.
+func (x *DrifterX) snapshotLeases() []snapshotRecord {
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	records := make([]snapshotRecord, 0, len(x.leases))
+	for id, l := range x.leases {
+		c := &Command{
+			OpType:  OpLeaseGrant,
+			LeaseID: id,
+			Value:   appendUvarint(nil, uint64(l.deadline)),
+			Time:    l.grantedAt,
+			TTL:     int64(l.ttl),
+		}
+		records = append(records, snapshotRecord{
+			kind:  recordLease,
+			key:   appendUvarint(nil, id),
+			value: encodeCommand(c),
+		})
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return string(records[i].key) < string(records[j].key)
+	})
+	return records
+}
+
+// resetLeases forgets all lease state ahead of a snapshot restore.
+func (x *DrifterX) resetLeases() {
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	x.leases = map[uint64]*lease{}
+	x.keyLeases = map[string]uint64{}
+}
+
+// restoreLease recreates a lease saved by snapshotLeases.
+func (x *DrifterX) restoreLease(rec snapshotRecord) error {
+	c, err := decodeCommand(rec.value)
+	if err != nil {
+		return fmt.Errorf("decoding lease record: %v", err)
+	}
+	deadline, err := uintPayload(c.Value)
+	if err != nil {
+		return errors.New("decoding lease record: bad deadline")
+	}
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	x.leases[c.LeaseID] = &lease{
+		grantedAt: c.Time,
+		deadline:  int64(deadline),
+		ttl:       time.Duration(c.TTL),
+		keys:      map[string]struct{}{},
+	}
+	return nil
+}
@@ -2,15 +2,16 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	pb "github.com/Jille/raft-grpc-example/proto"
 	"github.com/LaJunkai/drifterdb"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"path/filepath"
-	"strconv"
 	"time"
 
 	"github.com/Jille/raft-grpc-leader-rpc/leaderhealth"
@@ -21,68 +22,170 @@ import (
 	"github.com/hashicorp/raft"
 	boltdb "github.com/hashicorp/raft-boltdb"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/reflection"
+	"gopkg.in/yaml.v2"
 )
 
 var (
-	// 命令行参数，tcp地址、raftID、raft目录、是否是bootstrap
-	myAddr = flag.String("address", "localhost:51127", "tcp协议的IP＋port(port值应介于10000 和 65500之间)，如localhost:51127，其中[port % 10000]的值将用于http服务")
-	raftId = flag.String("raft_id", "nodeA", "节点ID")
-	raftDir       = flag.String("raft_data_dir", "cluster", "Raft日志存储的根目录")
-	raftBootstrap = flag.Bool("bootstrap", false, "是否是创世节点")
+	configFile  = flag.String("config", "", "YAML 配置文件的路径，未指定时使用默认配置")
+	printConfig = flag.Bool("print-config", false, "校验并输出生效的配置后退出")
+	// 以下参数覆盖配置文件与环境变量中的对应配置项，仅在显式指定时生效
+	myAddr        = flag.String("address", "", "gRPC 服务的监听端口与对外地址，如localhost:51127，对应 grpc.listen 与 grpc.advertise")
+	httpAddr      = flag.String("http_address", "", "HTTP 服务的监听端口与对外地址，如localhost:1127，对应 http.listen 与 http.advertise")
+	raftId        = flag.String("raft_id", "", "节点ID，对应 node_id")
+	raftDir       = flag.String("raft_data_dir", "", "Raft日志存储的根目录，对应 raft.data_dir")
+	raftBootstrap = flag.Bool("bootstrap", false, "是否是创世节点，对应 bootstrap")
+	forwardMode   = flag.String("forward_mode", "", "非leader节点收到写请求时的处理方式：forward(转发给leader) redirect(返回leader地址) reject(拒绝)，对应 forward_mode")
 )
 
+// dialOptions are used for every connection between the nodes of the cluster.
+var dialOptions = []grpc.DialOption{grpc.WithInsecure()}
+
+// applyFlags overrides cfg with the flags given on the command line.
+func applyFlags(cfg *Config) error {
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		var e error
+		switch f.Name {
+		case "address":
+			e = setAddress(&cfg.GRPC, *myAddr)
+		case "http_address":
+			e = setAddress(&cfg.HTTP, *httpAddr)
+		case "raft_id":
+			cfg.NodeID = *raftId
+		case "raft_data_dir":
+			cfg.Raft.DataDir = *raftDir
+		case "bootstrap":
+			cfg.Bootstrap = *raftBootstrap
+		case "forward_mode":
+			cfg.ForwardMode = *forwardMode
+		}
+		if e != nil && err == nil {
+			err = fmt.Errorf("flag --%s: %v", f.Name, e)
+		}
+	})
+	return err
+}
+
+// setAddress makes a listen on every interface at the port of addr and
+// advertise addr.
+func setAddress(a *AddressConfig, addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	a.Listen = ":" + port
+	a.Advertise = addr
+	return nil
+}
+
 func main() {
 	// 从命令行获取参数
 	flag.Parse()
 
-	if *raftId == "" {
-		log.Fatalf("flag --raft_id is required")
+	cfg, err := LoadConfig(*configFile)
+	if err == nil {
+		err = applyFlags(cfg)
 	}
-
-	ctx := context.Background()
-	// split地址ip和端口
-	_, port, err := net.SplitHostPort(*myAddr)
-	if intPort, _ := strconv.Atoi(port); intPort < 10000 {
-		log.Fatalf("参数 --address 中包含的端口号应该大于10000")
+	if err == nil {
+		err = cfg.Validate()
 	}
 	if err != nil {
-		log.Fatalf("failed to parse local address (%q): %v", *myAddr, err)
+		log.Fatalf("failed to load config: %v", err)
+	}
+	if *printConfig {
+		b, err := yaml.Marshal(cfg)
+		if err != nil {
+			log.Fatalf("failed to print config: %v", err)
+		}
+		os.Stdout.Write(b)
+		return
+	}
+
+	var serverTLS *tls.Config
+	var creds []grpc.ServerOption
+	if cfg.TLS.Enabled() {
+		var clientTLS *tls.Config
+		if serverTLS, clientTLS, err = cfg.TLS.tlsConfigs(); err != nil {
+			log.Fatalf("failed to load config: %v", err)
+		}
+		creds = append(creds, grpc.Creds(credentials.NewTLS(serverTLS)))
+		dialOptions = []grpc.DialOption{grpc.WithTransportCredentials(credentials.NewTLS(clientTLS))}
 	}
+
+	ctx := context.Background()
 	// 监听tcp端口
-	sock, err := net.Listen("tcp", fmt.Sprintf(":%s", port))
+	sock, err := net.Listen("tcp", cfg.GRPC.Listen)
 	if err != nil {
 		log.Fatalf("failed to listen: %v", err)
 	}
+	var raftSock net.Listener
+	if cfg.Raft.Listen != "" {
+		if raftSock, err = net.Listen("tcp", cfg.Raft.Listen); err != nil {
+			log.Fatalf("failed to listen: %v", err)
+		}
+	}
 	// 实例化wordTracker
-	db := drifterdb.OpenDB("db/" + *raftId)
+	db := drifterdb.OpenDB(filepath.Join(cfg.DB.DataDir, cfg.NodeID))
 	drifterX := NewDrifterX(db)
 	// 实例化Raft，传入context、id、监听地址、状态机；获取transport manager
-	r, tm, err := NewRaft(ctx, *raftId, *myAddr, drifterX)
+	r, tm, err := NewRaft(ctx, cfg, drifterX)
 	if err != nil {
 		log.Fatalf("failed to start raft: %v", err)
 	}
 	//// 创建一个grpc服务器
-	s := grpc.NewServer()
+	// KV 服务的错误统一补充错误码与本地化信息
+	s := grpc.NewServer(append([]grpc.ServerOption{
+		grpc.UnaryInterceptor(errorUnaryInterceptor(r)),
+		grpc.StreamInterceptor(errorStreamInterceptor(r)),
+	}, creds...)...)
 	//// 注册服务器，grpc的方法, 改成http服务对外暴露
-	pb.RegisterExampleServer(s, &rpcInterface{
+	pb.RegisterKVServer(s, &rpcInterface{
 		drifterX: drifterX, // 状态机实例
 		raft:     r,        // Raft实例
 	})
-	tm.Register(s)
-	leaderhealth.Setup(r, s, []string{"Example"})
-	raftadmin.Register(s, r)
+	fwd, err := newLeaderForwarder(r, cfg.ForwardMode)
+	if err != nil {
+		log.Fatalf("forward_mode: %v", err)
+	}
+	router := NewDrifterRouter(drifterX, r, fwd, raft.ServerID(cfg.NodeID))
+	// Raft transport、转发与管理接口默认与 KV 服务共用一个 gRPC 服务器，
+	// 配置了 raft.listen 时单独监听。它们不做鉴权，共用且未配置 tls.ca_file
+	// 时任何能访问 grpc.listen 的客户端都能调用，见 README 与 Config.Validate
+	internal := s
+	if cfg.Raft.Listen != "" {
+		internal = grpc.NewServer(creds...)
+	}
+	pb.RegisterForwarderServer(internal, &forwarderServer{handler: router, raft: r})
+	tm.Register(internal)
+	raftadmin.Register(internal, r)
+	leaderhealth.Setup(r, s, []string{"drifterx.KV"})
 	reflection.Register(s)
-	go StartDrifterServer(db, r)
-	fmt.Println("after")
+	if internal != s {
+		go func() {
+			if err := internal.Serve(raftSock); err != nil {
+				log.Fatalf("failed to serve raft: %v", err)
+			}
+		}()
+	}
+	go StartDrifterServer(router, cfg.HTTP.Listen, serverTLS)
+	go RunExpiry(r, drifterX)
+	go RunAdvertise(r, drifterX, fwd, cfg.NodeID, NodeEndpoints{
+		Raft: cfg.RaftAdvertise(),
+		GRPC: cfg.GRPC.Advertise,
+		HTTP: cfg.HTTP.Advertise,
+	})
+	log.Printf("node %s serving gRPC on %s and HTTP on %s", cfg.NodeID, cfg.GRPC.Listen, cfg.HTTP.Listen)
+	if internal != s {
+		log.Printf("node %s serving Raft on %s", cfg.NodeID, cfg.Raft.Listen)
+	}
 	if err := s.Serve(sock); err != nil {
 		log.Fatalf("failed to serve: %v", err)
 	}
 }
 
-func StartDrifterServer(db drifterdb.BaseDB, r *raft.Raft) {
-
-
+func NewDrifterRouter(x *DrifterX, r *raft.Raft, fwd *leaderForwarder, self raft.ServerID) *gin.Engine {
 	router := gin.Default()
 	router.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"*"},
@@ -95,26 +198,39 @@ func StartDrifterServer(db drifterdb.BaseDB, r *raft.Raft) {
 		},
 		MaxAge: 12 * time.Hour,
 	}))
-	router.POST("/db/put", PutHandler(db, r))
-	router.POST("/db/get", GetHandler(db, r))
-	router.POST("/db/delete", DeleteHandler(db, r))
-	router.POST("/db/start-transaction", StartTransactionHandler(db, r))
-	router.POST("/db/commit-transaction", GetHandler(db, r))
-	router.POST("/db/rollback-transaction", RollbackTransactionHandler(db, r))
-	router.GET("/machines/nodes", MachinesHandler(db, r))
-	router.GET("/machines/leader", LeaderHandler(db, r))
-	_, port, err := net.SplitHostPort(*myAddr)
-	if err != nil {
-		log.Fatalf("error occurred during parsing http address of the db: %v", err.Error())
+	// 写请求需要由leader处理
+	leaderOnly := fwd.Middleware()
+	for _, e := range writeEndpoints {
+		router.POST(e.path, leaderOnly, e.handler(r))
+	}
+	router.POST("/db/get", GetHandler(x, r))
+	router.POST("/db/range", RangeHandler(x, r))
+	router.GET("/db/transactions", TransactionsHandler(x))
+	router.GET("/db/leases", LeasesHandler(x))
+	router.GET("/db/watch", WatchHandler(x))
+	router.GET("/machines/nodes", MachinesHandler(x, r, fwd, self))
+	router.GET("/machines/leader", LeaderHandler(x, r, fwd, self))
+	return router
+}
+
+// StartDrifterServer serves the HTTP API on addr, over TLS if tlsConfig is
+// set.
+func StartDrifterServer(router *gin.Engine, addr string, tlsConfig *tls.Config) {
+	srv := &http.Server{Addr: addr, Handler: router, TLSConfig: tlsConfig}
+	var err error
+	if tlsConfig != nil {
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
 	}
-	router.Run(":" + port[1:])
+	log.Fatalf("failed to serve http: %v", err)
 }
 
-func NewRaft(ctx context.Context, myID, myAddress string, fsm raft.FSM) (*raft.Raft, *transport.Manager, error) {
-	c := raft.DefaultConfig()
-	c.LocalID = raft.ServerID(myID)
+func NewRaft(ctx context.Context, cfg *Config, fsm raft.FSM) (*raft.Raft, *transport.Manager, error) {
+	c := cfg.raftConfig()
+	myAddress := cfg.RaftAdvertise()
 
-	baseDir := filepath.Join(*raftDir, myID)
+	baseDir := filepath.Join(cfg.Raft.DataDir, cfg.NodeID)
 
 	ldb, err := boltdb.NewBoltStore(filepath.Join(baseDir, "logs.dat"))
 	if err != nil {
@@ -126,24 +242,24 @@ func NewRaft(ctx context.Context, myID, myAddress string, fsm raft.FSM) (*raft.R
 		return nil, nil, fmt.Errorf(`boltdb.NewBoltStore(%q): %v`, filepath.Join(baseDir, "stable.dat"), err)
 	}
 
-	fss, err := raft.NewFileSnapshotStore(baseDir, 3, os.Stderr)
+	fss, err := raft.NewFileSnapshotStore(baseDir, cfg.Raft.SnapshotRetain, os.Stderr)
 	if err != nil {
 		return nil, nil, fmt.Errorf(`raft.NewFileSnapshotStore(%q, ...): %v`, baseDir, err)
 	}
 
-	tm := transport.New(raft.ServerAddress(myAddress), []grpc.DialOption{grpc.WithInsecure()})
+	tm := transport.New(raft.ServerAddress(myAddress), dialOptions)
 
 	r, err := raft.NewRaft(c, fsm, ldb, sdb, fss, tm.Transport())
 	if err != nil {
 		return nil, nil, fmt.Errorf("raft.NewRaft: %v", err)
 	}
 
-	if *raftBootstrap {
+	if cfg.Bootstrap {
 		cfg := raft.Configuration{
 			Servers: []raft.Server{
 				{
 					Suffrage: raft.Voter,
-					ID:       raft.ServerID(myID),
+					ID:       c.LocalID,
 					Address:  raft.ServerAddress(myAddress),
 				},
 			},
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	pb "github.com/Jille/raft-grpc-example/proto"
+	"github.com/hashicorp/raft"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// 每个节点把自己的 Raft、gRPC 与 HTTP 对外地址作为集群元数据写入状态机，
+// 因此任意节点都能回答 /machines/nodes。只有 leader 能提交命令，follower
+// 通过内部 Forwarder 服务的 Advertise 调用请 leader 代为提交。节点离开 Raft
+// 配置后，leader 提交命令删除其地址，各节点关闭到其地址的连接。
+
+// NodeEndpoints are the addresses a node advertises.
+type NodeEndpoints struct {
+	Raft string `json:"raft"`
+	GRPC string `json:"grpc,omitempty"`
+	HTTP string `json:"http,omitempty"`
+}
+
+// 节点在集群中的角色
+const (
+	RoleLeader   = "leader"
+	RoleFollower = "follower"
+	RoleNonvoter = "nonvoter"
+	RoleStaging  = "staging"
+)
+
+// 节点的健康状态
+const (
+	HealthHealthy     = "healthy"
+	HealthUnreachable = "unreachable"
+)
+
+// NodeHealth is the result of probing a node.
+type NodeHealth struct {
+	Status string `json:"status"`
+	// Latency of the probe in milliseconds.
+	Latency float64 `json:"latency_ms"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// NodeInfo describes a member of the cluster, see GET /machines/nodes.
+type NodeInfo struct {
+	ID        string        `json:"id"`
+	Role      string        `json:"role"`
+	Endpoints NodeEndpoints `json:"endpoints"`
+	// Advertised reports whether the node published its endpoints. Until it
+	// does only its Raft address is known.
+	Advertised bool       `json:"advertised"`
+	Health     NodeHealth `json:"health"`
+}
+
+const (
+	// advertiseInterval is how often a node checks that the cluster metadata
+	// holds its current endpoints.
+	advertiseInterval = 5 * time.Second
+	// probeTimeout bounds the health check of a node.
+	probeTimeout = 500 * time.Millisecond
+)
+
+// advertiseCommand returns the OpNodeAdvertise command publishing the
+// endpoints of node id.
+func advertiseCommand(id string, endpoints NodeEndpoints) (*Command, error) {
+	if id == "" {
+		return nil, errors.New("node id is required")
+	}
+	if endpoints.Raft == "" {
+		return nil, errors.New("raft address is required")
+	}
+	value, err := json.Marshal(endpoints)
+	if err != nil {
+		return nil, err
+	}
+	return &Command{OpType: OpNodeAdvertise, Key: []byte(id), Value: value}, nil
+}
+
+// advertiseNode records the endpoints of an OpNodeAdvertise command.
+func (x *DrifterX) advertiseNode(c *Command) error {
+	var endpoints NodeEndpoints
+	if err := json.Unmarshal(c.Value, &endpoints); err != nil {
+		return fmt.Errorf("decoding node endpoints: %v", err)
+	}
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	x.nodes[string(c.Key)] = endpoints
+	return nil
+}
+
+// removeNode forgets the endpoints of node id.
+func (x *DrifterX) removeNode(id string) {
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	delete(x.nodes, id)
+}
+
+// nodeIDs returns the ids of the nodes that advertised their endpoints.
+func (x *DrifterX) nodeIDs() []string {
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	ids := make([]string, 0, len(x.nodes))
+	for id := range x.nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// nodeEndpoints returns the endpoints node id advertised.
+func (x *DrifterX) nodeEndpoints(id string) (NodeEndpoints, bool) {
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	endpoints, ok := x.nodes[id]
+	return endpoints, ok
+}
+
+// snapshotNodes encodes the endpoints of every node as a snapshot record,
+// reusing the command encoding like snapshotLeases.
+func (x *DrifterX) snapshotNodes() []snapshotRecord {
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	records := make([]snapshotRecord, 0, len(x.nodes))
+	for id, endpoints := range x.nodes {
+		value, _ := json.Marshal(endpoints)
+		records = append(records, snapshotRecord{
+			kind:  recordNode,
+			key:   []byte(id),
+			value: encodeCommand(&Command{OpType: OpNodeAdvertise, Key: []byte(id), Value: value}),
+		})
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return string(records[i].key) < string(records[j].key)
+	})
+	return records
+}
+
+// resetNodes forgets all node endpoints ahead of a snapshot restore.
+func (x *DrifterX) resetNodes() {
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	x.nodes = map[string]NodeEndpoints{}
+}
+
+// restoreNode recreates the node endpoints saved by snapshotNodes.
+func (x *DrifterX) restoreNode(rec snapshotRecord) error {
+	c, err := decodeCommand(rec.value)
+	if err != nil {
+		return fmt.Errorf("decoding node record: %v", err)
+	}
+	if err := x.advertiseNode(c); err != nil {
+		return fmt.Errorf("decoding node record: %v", err)
+	}
+	return nil
+}
+
+// RunAdvertise keeps the endpoints of this node in the cluster metadata. It
+// publishes them once a leader is known and again whenever the replicated
+// state differs, e.g. after the addresses changed in the configuration. It
+// also prunes the nodes that left the Raft configuration, see pruneNodes.
+func RunAdvertise(r *raft.Raft, x *DrifterX, fwd *leaderForwarder, id string, endpoints NodeEndpoints) {
+	ticker := time.NewTicker(advertiseInterval)
+	defer ticker.Stop()
+	for ; ; <-ticker.C {
+		if err := advertiseSelf(r, x, fwd, id, endpoints); err != nil {
+			log.Printf("failed to advertise the endpoints of node %s: %v", id, err)
+		}
+		if err := pruneNodes(r, x, fwd); err != nil {
+			log.Printf("failed to prune departed nodes: %v", err)
+		}
+	}
+}
+
+// advertiseSelf publishes the endpoints of node id unless the cluster
+// metadata holds them already or no leader is known.
+func advertiseSelf(r *raft.Raft, x *DrifterX, fwd *leaderForwarder, id string, endpoints NodeEndpoints) error {
+	if current, ok := x.nodeEndpoints(id); ok && current == endpoints {
+		return nil
+	}
+	leader := r.Leader()
+	if leader == "" {
+		return nil
+	}
+	if r.State() != raft.Leader {
+		return fwd.advertise(leader, id, endpoints)
+	}
+	cmd, err := advertiseCommand(id, endpoints)
+	if err != nil {
+		return err
+	}
+	_, _, err = applyCommand(context.Background(), r, cmd)
+	return err
+}
+
+// pruneNodes forgets the nodes that are no longer part of the Raft
+// configuration: the leader removes their endpoints from the cluster metadata
+// and every node closes its connections to addresses no member uses.
+func pruneNodes(r *raft.Raft, x *DrifterX, fwd *leaderForwarder) error {
+	future := r.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return err
+	}
+	members := map[string]bool{}
+	addrs := map[string]bool{}
+	for _, srv := range future.Configuration().Servers {
+		members[string(srv.ID)] = true
+		addrs[string(srv.Address)] = true
+		if endpoints, ok := x.nodeEndpoints(string(srv.ID)); ok && endpoints.GRPC != "" {
+			addrs[endpoints.GRPC] = true
+		}
+	}
+	fwd.closeConns(func(addr string) bool { return !addrs[addr] })
+	if r.State() != raft.Leader {
+		return nil
+	}
+	for _, id := range x.nodeIDs() {
+		if members[id] {
+			continue
+		}
+		if _, _, err := applyCommand(context.Background(), r, &Command{OpType: OpNodeRemove, Key: []byte(id)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// advertise asks the leader to record the endpoints of node id.
+func (f *leaderForwarder) advertise(leader raft.ServerAddress, id string, endpoints NodeEndpoints) error {
+	client, err := f.client(leader)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), forwardTimeout)
+	defer cancel()
+	_, err = client.Advertise(ctx, &pb.AdvertiseRequest{
+		NodeId:      id,
+		RaftAddress: endpoints.Raft,
+		GrpcAddress: endpoints.GRPC,
+		HttpAddress: endpoints.HTTP,
+	})
+	return err
+}
+
+// Advertise records the endpoints of a follower. Only the leader accepts it.
+func (s *forwarderServer) Advertise(ctx context.Context, req *pb.AdvertiseRequest) (*pb.AdvertiseResponse, error) {
+	if s.raft.State() != raft.Leader {
+		return nil, toStatus(errNotLeader)
+	}
+	cmd, err := advertiseCommand(req.GetNodeId(), NodeEndpoints{
+		Raft: req.GetRaftAddress(),
+		GRPC: req.GetGrpcAddress(),
+		HTTP: req.GetHttpAddress(),
+	})
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	index, _, err := applyCommand(ctx, s.raft, cmd)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &pb.AdvertiseResponse{CommitIndex: index}, nil
+}
+
+// listNodes returns the members of the Raft configuration with their
+// endpoints, role and health. Every node but the local one is probed with a
+// gRPC health check at its advertised gRPC address, or its Raft address if it
+// did not advertise one; a node that answers at all is healthy.
+func listNodes(ctx context.Context, x *DrifterX, r *raft.Raft, fwd *leaderForwarder, self raft.ServerID) ([]NodeInfo, error) {
+	future := r.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+	leader := r.Leader()
+	servers := future.Configuration().Servers
+	nodes := make([]NodeInfo, len(servers))
+	var wg sync.WaitGroup
+	for i, srv := range servers {
+		n := &nodes[i]
+		n.ID = string(srv.ID)
+		switch {
+		case leader != "" && srv.Address == leader:
+			n.Role = RoleLeader
+		case srv.Suffrage == raft.Nonvoter:
+			n.Role = RoleNonvoter
+		case srv.Suffrage == raft.Staging:
+			n.Role = RoleStaging
+		default:
+			n.Role = RoleFollower
+		}
+		n.Endpoints, n.Advertised = x.nodeEndpoints(n.ID)
+		// Raft 配置中的地址才是集群实际使用的地址
+		n.Endpoints.Raft = string(srv.Address)
+		if srv.ID == self {
+			n.Health = NodeHealth{Status: HealthHealthy}
+			continue
+		}
+		addr := n.Endpoints.GRPC
+		if addr == "" {
+			addr = n.Endpoints.Raft
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n.Health = probeNode(ctx, fwd, addr)
+		}()
+	}
+	wg.Wait()
+	return nodes, nil
+}
+
+// probeNode checks that the node at addr answers gRPC requests.
+func probeNode(ctx context.Context, fwd *leaderForwarder, addr string) NodeHealth {
+	start := time.Now()
+	conn, err := fwd.conn(addr)
+	if err == nil {
+		ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+		defer cancel()
+		_, err = healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	}
+	h := NodeHealth{Status: HealthHealthy, Latency: float64(time.Since(start)) / float64(time.Millisecond)}
+	switch status.Code(err) {
+	case codes.OK, codes.NotFound, codes.Unimplemented:
+		// 未注册健康检查服务的节点同样说明其可以访问
+	default:
+		h.Status = HealthUnreachable
+		h.Error = err.Error()
+	}
+	return h
+}
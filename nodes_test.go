@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+)
+
+// TestPruneNodes checks that the endpoints of a node removed from the Raft
+// configuration are dropped on every replica and that the connections to its
+// addresses are closed.
+func TestPruneNodes(t *testing.T) {
+	c := newTestCluster(t, 3, nil)
+	defer c.shutdown()
+
+	for _, node := range c.nodes {
+		cmd, err := advertiseCommand(string(node.id), NodeEndpoints{
+			Raft: string(node.addr),
+			GRPC: "127.0.0.1:" + string(node.id),
+			HTTP: "127.0.0.1:" + string(node.id),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.apply(cmd); err != nil {
+			t.Fatalf("advertising %s: %v", node.id, err)
+		}
+	}
+	leader := c.leader()
+	var removed *testNode
+	for _, node := range c.nodes {
+		if node != leader {
+			removed = node
+			break
+		}
+	}
+	if err := leader.raft.RemoveServer(removed.id, 0, 0).Error(); err != nil {
+		t.Fatalf("removing %s: %v", removed.id, err)
+	}
+
+	fwd, err := newLeaderForwarder(leader.raft, ForwardModeRedirect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoints, _ := leader.fsm.nodeEndpoints(string(leader.id))
+	for _, addr := range []string{endpoints.GRPC, "127.0.0.1:" + string(removed.id)} {
+		if _, err := fwd.conn(addr); err != nil {
+			t.Fatalf("dialing %s: %v", addr, err)
+		}
+	}
+	if err := pruneNodes(leader.raft, leader.fsm, fwd); err != nil {
+		t.Fatalf("pruneNodes: %v", err)
+	}
+
+	if _, ok := fwd.conns[endpoints.GRPC]; !ok {
+		t.Errorf("connection to member %s was closed", leader.id)
+	}
+	if _, ok := fwd.conns["127.0.0.1:"+string(removed.id)]; ok {
+		t.Errorf("connection to removed node %s was kept", removed.id)
+	}
+	for _, node := range c.nodes {
+		if node == removed {
+			continue
+		}
+		c.waitFor("the removed node to be pruned on "+string(node.id), func() bool {
+			_, ok := node.fsm.nodeEndpoints(string(removed.id))
+			return !ok && len(node.fsm.nodeIDs()) == 2
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package recipes
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/Jille/raft-grpc-example/client"
+)
+
+// ErrNotElectionValue is returned when the key of an election holds a value
+// that is not a string, so it was not written by an Election.
+var ErrNotElectionValue = errors.New("election key does not hold a string value")
+
+// Election elects one leader among the sessions campaigning on a key. The
+// leader's value is stored under the key, so observers can find the leader.
+type Election struct {
+	s   *Session
+	key string
+
+	mtx sync.Mutex
+	rev uint64
+}
+
+// NewElection returns the election stored under key.
+func NewElection(s *Session, key string) *Election {
+	return &Election{s: s, key: key}
+}
+
+// Campaign blocks until the session is elected, the session ends or ctx is
+// done. Once elected, value is published as the leader's value.
+func (e *Election) Campaign(ctx context.Context, value string) error {
+	rev, err := e.s.claim(ctx, e.key, value)
+	if err != nil {
+		return err
+	}
+	e.mtx.Lock()
+	e.rev = rev
+	e.mtx.Unlock()
+	// 会话此前已当选时 claim 不会写入新的值
+	return e.Proclaim(ctx, value)
+}
+
+// Proclaim publishes a new value while the session is the leader. It returns
+// ErrNotHeld if the session is not (anymore) the leader.
+func (e *Election) Proclaim(ctx context.Context, value string) error {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	if e.rev == 0 {
+		return ErrNotHeld
+	}
+	rev, err := e.s.lease.PutIf(ctx, e.key, value, client.IfModRevisionEquals(e.rev))
+	if client.IsPreconditionFailed(err) {
+		e.rev = 0
+		return ErrNotHeld
+	}
+	if err != nil {
+		return err
+	}
+	e.rev = rev
+	return nil
+}
+
+// Resign gives up leadership, letting another campaigner be elected.
+func (e *Election) Resign(ctx context.Context) error {
+	e.mtx.Lock()
+	rev := e.rev
+	e.rev = 0
+	e.mtx.Unlock()
+	if rev == 0 {
+		return ErrNotHeld
+	}
+	return e.s.release(ctx, e.key, rev)
+}
+
+// FencingToken returns the revision of the leader's last write, or 0 if the
+// session is not the leader.
+func (e *Election) FencingToken() uint64 {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	return e.rev
+}
+
+// Leader returns the current leader's value. It returns client.ErrNotFound if
+// there is no leader.
+func (e *Election) Leader(ctx context.Context) (string, error) {
+	kv, err := e.s.c.GetKV(ctx, e.key, client.TypeString, client.Linearizable)
+	if err != nil {
+		return "", err
+	}
+	leader, ok := kv.Value.(string)
+	if !ok {
+		return "", ErrNotElectionValue
+	}
+	return leader, nil
+}
+
+// Observe sends the leader's value every time it changes, and "" while there
+// is no leader. The channel is closed when ctx is done, the watch fails or the
+// key holds a value that is not a string.
+func (e *Election) Observe(ctx context.Context) <-chan string {
+	ch := make(chan string)
+	go func() {
+		defer close(ch)
+		for ctx.Err() == nil {
+			if err := e.observe(ctx, ch); err != nil {
+				if _, ok := err.(*client.CompactedError); !ok {
+					return
+				}
+			}
+		}
+	}()
+	return ch
+}
+
+// observe sends the current leader and then every change until the watch
+// fails.
+func (e *Election) observe(ctx context.Context, ch chan<- string) error {
+	var leader string
+	var rev uint64
+	kv, err := e.s.c.GetKV(ctx, e.key, client.TypeString, client.Linearizable)
+	switch {
+	case err == nil:
+		var ok bool
+		if leader, ok = kv.Value.(string); !ok {
+			return ErrNotElectionValue
+		}
+		rev = kv.ModRevision
+	case err != client.ErrNotFound:
+		return err
+	}
+	select {
+	case ch <- leader:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	opts := client.WatchOptions{Type: client.TypeString}
+	if rev != 0 {
+		opts.StartRevision = rev + 1
+	}
+	w, err := e.s.c.Watch(ctx, e.key, opts)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	for {
+		events, err := w.Recv()
+		if err != nil {
+			return err
+		}
+		for _, ev := range events {
+			leader = ""
+			if !ev.Deleted {
+				var ok bool
+				if leader, ok = ev.KV.Value.(string); !ok {
+					return ErrNotElectionValue
+				}
+			}
+			select {
+			case ch <- leader:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package recipes
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var (
+	// ErrSessionExpired is returned when the session of a primitive ended.
+	ErrSessionExpired = errors.New("session expired")
+	// ErrNotHeld is returned when releasing a key the session does not hold
+	// (anymore).
+	ErrNotHeld = errors.New("not held by this session")
+	// ErrLocked is returned by TryLock when the mutex is held by someone else.
+	ErrLocked = errors.New("mutex is locked by another session")
+)
+
+// Mutex is a distributed lock. Holders are sessions: a session that locked a
+// mutex holds it until it unlocks it or the session ends, and locking it again
+// through the same session succeeds immediately. Goroutines that compete for
+// the same mutex therefore need a session each.
+type Mutex struct {
+	s   *Session
+	key string
+
+	mtx sync.Mutex
+	rev uint64
+}
+
+// NewMutex returns the mutex stored under key.
+func NewMutex(s *Session, key string) *Mutex {
+	return &Mutex{s: s, key: key}
+}
+
+// Lock blocks until the mutex is acquired, the session ends or ctx is done.
+func (m *Mutex) Lock(ctx context.Context) error {
+	rev, err := m.s.claim(ctx, m.key, m.s.owner())
+	if err != nil {
+		return err
+	}
+	m.setRevision(rev)
+	return nil
+}
+
+// TryLock acquires the mutex if it is free and returns ErrLocked otherwise.
+func (m *Mutex) TryLock(ctx context.Context) error {
+	rev, err := m.s.tryClaim(ctx, m.key, m.s.owner())
+	if err == errHeld {
+		return ErrLocked
+	}
+	if err != nil {
+		return err
+	}
+	m.setRevision(rev)
+	return nil
+}
+
+// Unlock releases the mutex. It returns ErrNotHeld if the mutex was lost,
+// for example because the session expired.
+func (m *Mutex) Unlock(ctx context.Context) error {
+	m.mtx.Lock()
+	rev := m.rev
+	m.rev = 0
+	m.mtx.Unlock()
+	if rev == 0 {
+		return ErrNotHeld
+	}
+	return m.s.release(ctx, m.key, rev)
+}
+
+// FencingToken returns the revision at which the mutex was acquired, or 0 if
+// it is not held. Tokens of later holders are larger.
+func (m *Mutex) FencingToken() uint64 {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.rev
+}
+
+// Key returns the key the mutex is stored under.
+func (m *Mutex) Key() string {
+	return m.key
+}
+
+func (m *Mutex) setRevision(rev uint64) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.rev = rev
+}
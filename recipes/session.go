@@ -0,0 +1,186 @@
+// Package recipes implements coordination primitives on top of a DrifterX
+// cluster.
+//
+// Every primitive is built from the cluster's atomic commands: a key is
+// claimed with a put that only succeeds if the key is absent, attached to the
+// lease of a Session so it disappears when its holder dies, and waited for
+// with a watch. The mod revision of the claiming put, which is the Raft log
+// index it was committed at, serves as fencing token: it grows with every
+// new holder, so storage that remembers the largest token it has seen can
+// reject writes from a holder that lost the key without noticing.
+package recipes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Jille/raft-grpc-example/client"
+)
+
+// DefaultSessionTTL is the lease TTL of a session created with a zero TTL.
+const DefaultSessionTTL = 15 * time.Second
+
+// Session is a lease kept alive in the background. Keys claimed through a
+// session are released when the session is closed or its process dies.
+type Session struct {
+	c     *client.Client
+	lease *client.Lease
+
+	cancel context.CancelFunc
+	done   chan struct{}
+	once   sync.Once
+}
+
+// NewSession grants a lease with the given TTL and keeps it alive until the
+// session is closed.
+func NewSession(ctx context.Context, c *client.Client, ttl time.Duration) (*Session, error) {
+	if ttl <= 0 {
+		ttl = DefaultSessionTTL
+	}
+	lease, err := c.Grant(ctx, ttl)
+	if err != nil {
+		return nil, err
+	}
+	keepAliveCtx, cancel := context.WithCancel(context.Background())
+	s := &Session{c: c, lease: lease, cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		lease.KeepAliveLoop(keepAliveCtx)
+	}()
+	return s, nil
+}
+
+// Client returns the client the session was created with.
+func (s *Session) Client() *client.Client {
+	return s.c
+}
+
+// Lease returns the id of the session's lease.
+func (s *Session) Lease() uint64 {
+	return s.lease.ID
+}
+
+// Done is closed when the session ends, either because it was closed or
+// because its lease no longer exists.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Close stops keeping the lease alive and revokes it, releasing every key
+// held through the session.
+func (s *Session) Close(ctx context.Context) error {
+	var err error
+	s.once.Do(func() {
+		s.cancel()
+		<-s.done
+		err = s.lease.Revoke(ctx)
+	})
+	return err
+}
+
+// owner is the value a session writes into the keys it claims.
+func (s *Session) owner() string {
+	return fmt.Sprintf("%x", s.lease.ID)
+}
+
+// claim puts value under key attached to the session's lease, waiting for the
+// key to be deleted while someone else holds it. It returns the mod revision of
+// the put. If the session already holds key, its current revision is returned.
+func (s *Session) claim(ctx context.Context, key, value string) (uint64, error) {
+	for {
+		rev, err := s.tryClaim(ctx, key, value)
+		if err != errHeld {
+			return rev, err
+		}
+		if err := s.waitDeleted(ctx, key); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// errHeld is returned by tryClaim when someone else holds the key.
+var errHeld = errors.New("key is held by another session")
+
+func (s *Session) tryClaim(ctx context.Context, key, value string) (uint64, error) {
+	select {
+	case <-s.done:
+		return 0, ErrSessionExpired
+	default:
+	}
+	rev, err := s.lease.PutIf(ctx, key, value, client.IfAbsent())
+	if err == nil {
+		return rev, nil
+	}
+	if !client.IsPreconditionFailed(err) {
+		return 0, err
+	}
+	kv, err := s.c.GetKV(ctx, key, client.TypeString, client.Linearizable)
+	switch {
+	case err == client.ErrNotFound:
+		// 刚刚被释放，重新尝试
+		return s.tryClaim(ctx, key, value)
+	case err != nil:
+		return 0, err
+	case kv.Lease == s.lease.ID:
+		// 之前的请求已经成功，只是响应丢失了
+		return kv.ModRevision, nil
+	}
+	return 0, errHeld
+}
+
+// waitDeleted blocks until key is deleted, the session ends or ctx is done.
+func (s *Session) waitDeleted(ctx context.Context, key string) error {
+	kv, err := s.c.GetKV(ctx, key, client.TypeString, client.Linearizable)
+	if err == client.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-s.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	w, err := s.c.Watch(ctx, key, client.WatchOptions{StartRevision: kv.ModRevision + 1, Type: client.TypeString})
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	for {
+		events, err := w.Recv()
+		if _, ok := err.(*client.CompactedError); ok {
+			// 错过了部分事件，由调用方重新检查
+			return nil
+		}
+		if err != nil {
+			select {
+			case <-s.done:
+				return ErrSessionExpired
+			default:
+			}
+			return err
+		}
+		for _, ev := range events {
+			if ev.Deleted || ev.KV.Lease != kv.Lease {
+				return nil
+			}
+		}
+	}
+}
+
+// release deletes key if it is still held at revision rev.
+func (s *Session) release(ctx context.Context, key string, rev uint64) error {
+	_, err := s.c.DeleteIf(ctx, key, client.IfModRevisionEquals(rev))
+	if client.IsPreconditionFailed(err) {
+		return ErrNotHeld
+	}
+	return err
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Jille/raft-grpc-example/client"
+	"github.com/Jille/raft-grpc-example/recipes"
+)
+
+// newTestSession connects a client of its own to addrs and starts a session
+// with the given TTL.
+func newTestSession(t *testing.T, addrs []string, ttl time.Duration) *recipes.Session {
+	c, err := client.New(addrs, client.Options{})
+	if err != nil {
+		t.Fatalf("client.New: %v", err)
+	}
+	s, err := recipes.NewSession(context.Background(), c, ttl)
+	if err != nil {
+		c.Close()
+		t.Fatalf("recipes.NewSession: %v", err)
+	}
+	return s
+}
+
+// closeTestSession revokes the session and closes its client.
+func closeTestSession(t *testing.T, s *recipes.Session) {
+	if err := s.Close(context.Background()); err != nil {
+		t.Errorf("closing the session: %v", err)
+	}
+	s.Client().Close()
+}
+
+// TestMutexExclusion lets several sessions compete for one mutex and checks
+// that at most one of them holds it at a time and that every holder gets a
+// larger fencing token than the one before.
+func TestMutexExclusion(t *testing.T) {
+	c := newTestCluster(t, 3, nil)
+	defer c.shutdown()
+	addrs := c.serveGRPC()
+
+	const sessions, rounds = 5, 4
+	var (
+		holders int32
+		mtx     sync.Mutex
+		tokens  []uint64
+		wg      sync.WaitGroup
+	)
+	for i := 0; i < sessions; i++ {
+		s := newTestSession(t, addrs, 10*time.Second)
+		defer closeTestSession(t, s)
+		m := recipes.NewMutex(s, "lock")
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+			defer cancel()
+			for j := 0; j < rounds; j++ {
+				if err := m.Lock(ctx); err != nil {
+					t.Errorf("Lock: %v", err)
+					return
+				}
+				if n := atomic.AddInt32(&holders, 1); n != 1 {
+					t.Errorf("%d sessions hold the mutex", n)
+				}
+				// 按获得锁的顺序记录 fencing token
+				mtx.Lock()
+				tokens = append(tokens, m.FencingToken())
+				mtx.Unlock()
+				time.Sleep(5 * time.Millisecond)
+				atomic.AddInt32(&holders, -1)
+				if err := m.Unlock(ctx); err != nil {
+					t.Errorf("Unlock: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(tokens) != sessions*rounds {
+		t.Fatalf("mutex was acquired %d times, want %d", len(tokens), sessions*rounds)
+	}
+	for i := 1; i < len(tokens); i++ {
+		if tokens[i] <= tokens[i-1] {
+			t.Errorf("fencing token %d of holder %d is not larger than %d of the holder before", tokens[i], i, tokens[i-1])
+		}
+	}
+}
+
+// TestElectionFailover checks that a campaigner is elected once the lease of
+// the leader's session runs out, and that its fencing token is larger.
+func TestElectionFailover(t *testing.T) {
+	c := newTestCluster(t, 3, nil)
+	defer c.shutdown()
+	addrs := c.serveGRPC()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	first := newTestSession(t, addrs, time.Second)
+	defer first.Client().Close()
+	leader := recipes.NewElection(first, "election")
+	if err := leader.Campaign(ctx, "first"); err != nil {
+		t.Fatalf("first campaign: %v", err)
+	}
+	second := newTestSession(t, addrs, time.Second)
+	defer closeTestSession(t, second)
+	follower := recipes.NewElection(second, "election")
+	elected := make(chan error, 1)
+	go func() {
+		elected <- follower.Campaign(ctx, "second")
+	}()
+	select {
+	case err := <-elected:
+		t.Fatalf("second session was elected while the first one is alive: %v", err)
+	case <-time.After(3 * time.Second):
+	}
+
+	// 关闭连接后第一个会话无法续约，其租约到期后由 leader 回收
+	first.Client().Close()
+	if err := <-elected; err != nil {
+		t.Fatalf("second campaign: %v", err)
+	}
+	if got, err := follower.Leader(ctx); err != nil || got != "second" {
+		t.Errorf("leader: got %q (%v), want second", got, err)
+	}
+	if follower.FencingToken() <= leader.FencingToken() {
+		t.Errorf("fencing token %d of the new leader is not larger than %d of the old one", follower.FencingToken(), leader.FencingToken())
+	}
+}
+
+// TestElectionForeignValue checks that an election whose key holds a value
+// that is not a string reports an error instead of panicking.
+func TestElectionForeignValue(t *testing.T) {
+	c := newTestCluster(t, 1, nil)
+	defer c.shutdown()
+	addrs := c.serveGRPC()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	s := newTestSession(t, addrs, 10*time.Second)
+	defer closeTestSession(t, s)
+	if _, err := s.Client().Put(ctx, "election", 42); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	e := recipes.NewElection(s, "election")
+	if _, err := e.Leader(ctx); err != recipes.ErrNotElectionValue {
+		t.Errorf("Leader of a key holding an int: got %v, want %v", err, recipes.ErrNotElectionValue)
+	}
+	for leader := range e.Observe(ctx) {
+		t.Errorf("Observe sent %q for a key holding an int", leader)
+	}
+	if ctx.Err() != nil {
+		t.Errorf("Observe did not close its channel")
+	}
+}
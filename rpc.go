@@ -0,0 +1,568 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	pb "github.com/Jille/raft-grpc-example/proto"
+	"github.com/hashicorp/raft"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// rpcInterface implements the drifterx.KV gRPC service. Mutations are
+// submitted through applyCommand, the same Raft command path the HTTP
+// handlers use.
+type rpcInterface struct {
+	drifterX *DrifterX
+	raft     *raft.Raft
+}
+
+var _ pb.KVServer = rpcInterface{}
+
+// rpcTimeout bounds raft.Apply when the caller did not set a deadline.
+const rpcTimeout = time.Second
+
+func timeout(ctx context.Context) time.Duration {
+	if dl, ok := ctx.Deadline(); ok {
+		return time.Until(dl)
+	}
+	return rpcTimeout
+}
+
+// setCondition copies a gRPC write condition into cmd.
+func setCondition(cmd *Command, cond *pb.Condition) error {
+	switch k := cond.GetKind().(type) {
+	case nil:
+	case *pb.Condition_IfAbsent:
+		if k.IfAbsent {
+			cmd.Cond = CondIfAbsent
+		}
+	case *pb.Condition_IfValueEquals:
+		_, expected, err := ValueToBytes(k.IfValueEquals)
+		if err != nil {
+			return fmt.Errorf("if_value_equals: %v", err)
+		}
+		cmd.Cond = CondIfValueEquals
+		cmd.CondValue = expected
+	case *pb.Condition_IfVersionEquals:
+		cmd.Cond = CondIfVersionEquals
+		cmd.CondVersion = k.IfVersionEquals
+	case *pb.Condition_IfModRevisionEquals:
+		cmd.Cond = CondIfModRevisionEquals
+		cmd.CondRevision = k.IfModRevisionEquals
+	}
+	return nil
+}
+
+func consistencyName(c pb.Consistency) string {
+	switch c {
+	case pb.Consistency_STALE:
+		return ReadStale
+	case pb.Consistency_LEADER:
+		return ReadLeader
+	default:
+		return ReadLinearizable
+	}
+}
+
+func (r rpcInterface) Put(ctx context.Context, req *pb.PutRequest) (*pb.PutResponse, error) {
+	valueType, value, err := ValueToBytes(req.GetValue())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if req.GetTtlSeconds() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "ttl_seconds must not be negative")
+	}
+	cmd := &Command{
+		OpType:    OpPut,
+		Key:       req.GetKey(),
+		Value:     value,
+		ValueType: valueType,
+		TrxID:     req.GetTrxId(),
+		TTL:       keyTTL(req.GetTtlSeconds()),
+		LeaseID:   req.GetLease(),
+	}
+	if err := setCondition(cmd, req.GetCondition()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	index, _, err := applyCommand(ctx, r.raft, cmd)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &pb.PutResponse{CommitIndex: index}, nil
+}
+
+func (r rpcInterface) Increment(ctx context.Context, req *pb.IncrementRequest) (*pb.IncrementResponse, error) {
+	cmd := &Command{
+		OpType:  OpIncr,
+		Key:     req.GetKey(),
+		TrxID:   req.GetTrxId(),
+		Delta:   req.GetDelta(),
+		Initial: req.GetInitial(),
+	}
+	if req.GetHasMin() {
+		min := req.GetMin()
+		cmd.Min = &min
+	}
+	if req.GetHasMax() {
+		max := req.GetMax()
+		cmd.Max = &max
+	}
+	if cmd.Min != nil && cmd.Max != nil && *cmd.Min > *cmd.Max {
+		return nil, status.Error(codes.InvalidArgument, "min must not be greater than max")
+	}
+	index, resp, err := applyCommand(ctx, r.raft, cmd)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	v, ok := resp.(int64)
+	if !ok {
+		return nil, status.Errorf(codes.Internal, "unexpected response %v", resp)
+	}
+	return &pb.IncrementResponse{Value: v, CommitIndex: index}, nil
+}
+
+func (r rpcInterface) Get(ctx context.Context, req *pb.GetRequest) (*pb.GetResponse, error) {
+	if err := checkType(req.GetType()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := checkPointers(req.GetFields()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	index, err := r.drifterX.waitForRead(ctx, r.raft, consistencyName(req.GetConsistency()))
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	var reader kvReader = r.drifterX.db
+	if req.GetTrxId() != 0 {
+		trx := r.drifterX.transaction(req.GetTrxId())
+		if trx == nil {
+			return nil, toStatus(errTrxNotFound)
+		}
+		reader = trx
+	}
+	e, err := getLiveEntry(reader, req.GetKey(), time.Now().UnixNano())
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	resp := &pb.GetResponse{ReadAtIndex: index}
+	if e == nil {
+		return resp, nil
+	}
+	resp.Kv, err = entryToKeyValue(req.GetKey(), e, req.GetType())
+	if err == nil {
+		err = projectKeyValue(resp.Kv, e, req.GetFields())
+	}
+	if err != nil {
+		return nil, toStatus(decodeError(err))
+	}
+	resp.Found = true
+	return resp, nil
+}
+
+// entryToKeyValue converts e to its gRPC form, decoding the value as the type
+// it was written with. t is used for values stored without a type.
+func entryToKeyValue(key []byte, e *entry, t string) (*pb.KeyValue, error) {
+	if e.Type != "" {
+		t = e.Type
+	}
+	if t == "" {
+		return nil, fmt.Errorf("key %q: %v", key, errUntypedValue)
+	}
+	value, err := BytesToValue(t, e.Value)
+	if err != nil {
+		return nil, fmt.Errorf("key %q: %v", key, err)
+	}
+	return &pb.KeyValue{
+		Key:            key,
+		Value:          value,
+		CreateRevision: e.CreateRevision,
+		ModRevision:    e.ModRevision,
+		Version:        e.Version,
+		ExpiresAt:      e.ExpiresAt,
+		Lease:          e.Lease,
+		Type:           t,
+	}, nil
+}
+
+// projectKeyValue replaces the value of kv with the fields selected from the
+// json or list value of e, see projectDocument. It does nothing if fields is
+// empty.
+func projectKeyValue(kv *pb.KeyValue, e *entry, fields []string) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	v, err := projectDocument(e, kv.GetType(), fields)
+	if err != nil {
+		return fmt.Errorf("key %q: %v", kv.GetKey(), err)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	kv.Value = &pb.Value{Kind: &pb.Value_JsonValue{JsonValue: string(b)}}
+	return nil
+}
+
+func (r rpcInterface) Delete(ctx context.Context, req *pb.DeleteRequest) (*pb.DeleteResponse, error) {
+	cmd := &Command{
+		OpType: OpDel,
+		Key:    req.GetKey(),
+		TrxID:  req.GetTrxId(),
+	}
+	if err := setCondition(cmd, req.GetCondition()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	index, _, err := applyCommand(ctx, r.raft, cmd)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &pb.DeleteResponse{CommitIndex: index}, nil
+}
+
+func (r rpcInterface) CompareAndSwap(ctx context.Context, req *pb.CompareAndSwapRequest) (*pb.CompareAndSwapResponse, error) {
+	valueType, value, err := ValueToBytes(req.GetValue())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if req.GetTtlSeconds() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "ttl_seconds must not be negative")
+	}
+	var expected []byte
+	if req.GetExpected() != nil {
+		if _, expected, err = ValueToBytes(req.GetExpected()); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "expected: %v", err)
+		}
+	}
+	index, _, err := applyCommand(ctx, r.raft, &Command{
+		OpType:    OpCAS,
+		Key:       req.GetKey(),
+		Value:     value,
+		ValueType: valueType,
+		TrxID:     req.GetTrxId(),
+		CondValue: expected,
+		TTL:       keyTTL(req.GetTtlSeconds()),
+	})
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &pb.CompareAndSwapResponse{CommitIndex: index}, nil
+}
+
+// jsonRPCOps maps the op of an UpdateJSONRequest to its command.
+var jsonRPCOps = map[pb.UpdateJSONRequest_Op]int{
+	pb.UpdateJSONRequest_MERGE:  OpJSONMerge,
+	pb.UpdateJSONRequest_SET:    OpJSONSet,
+	pb.UpdateJSONRequest_REMOVE: OpJSONRemove,
+	pb.UpdateJSONRequest_APPEND: OpJSONAppend,
+}
+
+func (r rpcInterface) UpdateJSON(ctx context.Context, req *pb.UpdateJSONRequest) (*pb.UpdateJSONResponse, error) {
+	op, ok := jsonRPCOps[req.GetOp()]
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "unsupported op %v", req.GetOp())
+	}
+	if err := checkPointers([]string{req.GetPath()}); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if op != OpJSONRemove && !json.Valid([]byte(req.GetValue())) {
+		return nil, status.Error(codes.InvalidArgument, "value is not valid json")
+	}
+	index, resp, err := applyCommand(ctx, r.raft, &Command{
+		OpType: op,
+		Key:    req.GetKey(),
+		Value:  []byte(req.GetValue()),
+		Path:   req.GetPath(),
+		TrxID:  req.GetTrxId(),
+	})
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	doc, ok := resp.(json.RawMessage)
+	if !ok {
+		return nil, status.Errorf(codes.Internal, "unexpected response %v", resp)
+	}
+	return &pb.UpdateJSONResponse{Value: string(doc), CommitIndex: index}, nil
+}
+
+func (r rpcInterface) Range(ctx context.Context, req *pb.RangeRequest) (*pb.RangeResponse, error) {
+	db, index, err := r.prepareRange(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return rangePage(db, req, req.GetPageToken(), index)
+}
+
+func (r rpcInterface) RangeStream(req *pb.RangeRequest, stream pb.KV_RangeStreamServer) error {
+	db, index, err := r.prepareRange(stream.Context(), req)
+	if err != nil {
+		return err
+	}
+	token := req.GetPageToken()
+	for {
+		if err := stream.Context().Err(); err != nil {
+			return status.FromContextError(err).Err()
+		}
+		resp, err := rangePage(db, req, token, index)
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+		if token = resp.GetNextPageToken(); token == "" {
+			return nil
+		}
+	}
+}
+
+func (r rpcInterface) Watch(req *pb.WatchRequest, stream pb.KV_WatchServer) error {
+	if err := checkType(req.GetType()); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	hub := r.drifterX.watch
+	filter := WatchFilter{Key: req.GetKey(), Prefix: req.GetPrefix()}
+	rev := hub.startRevision(req.GetStartRevision())
+	for {
+		events, next, err := hub.wait(stream.Context(), rev, filter)
+		if compacted, ok := err.(*CompactedError); ok {
+			stream.Send(&pb.WatchResponse{CompactRevision: compacted.Revision})
+			return toStatus(err)
+		}
+		if err != nil {
+			return status.FromContextError(err).Err()
+		}
+		resp := &pb.WatchResponse{Events: make([]*pb.Event, 0, len(events))}
+		for _, ev := range events {
+			pe := &pb.Event{Revision: ev.Revision}
+			if ev.Type == EventDelete {
+				pe.Type = pb.Event_DELETE
+				pe.Kv = &pb.KeyValue{Key: ev.Key, ModRevision: ev.Revision}
+			} else if pe.Kv, err = entryToKeyValue(ev.Key, ev.Entry, req.GetType()); err != nil {
+				return toStatus(decodeError(err))
+			}
+			resp.Events = append(resp.Events, pe)
+		}
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+		rev = next
+	}
+}
+
+// prepareRange validates req and waits for the requested read consistency.
+func (r rpcInterface) prepareRange(ctx context.Context, req *pb.RangeRequest) (rangeReader, uint64, error) {
+	if err := checkType(req.GetType()); err != nil {
+		return nil, 0, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := checkPointers(req.GetFields()); err != nil {
+		return nil, 0, status.Error(codes.InvalidArgument, err.Error())
+	}
+	index, err := r.drifterX.waitForRead(ctx, r.raft, consistencyName(req.GetConsistency()))
+	if err != nil {
+		return nil, 0, toStatus(err)
+	}
+	if req.GetTrxId() == 0 {
+		return r.drifterX.db, index, nil
+	}
+	trx := r.drifterX.transaction(req.GetTrxId())
+	if trx == nil {
+		return nil, 0, toStatus(errTrxNotFound)
+	}
+	return trx, index, nil
+}
+
+func rangePage(db rangeReader, req *pb.RangeRequest, token string, index uint64) (*pb.RangeResponse, error) {
+	page, err := scanRange(db, RangeQuery{
+		StartKey:  req.GetStartKey(),
+		EndKey:    req.GetEndKey(),
+		Prefix:    req.GetPrefix(),
+		Reverse:   req.GetReverse(),
+		Now:       time.Now().UnixNano(),
+		Limit:     int(req.GetLimit()),
+		PageToken: token,
+	})
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	resp := &pb.RangeResponse{ReadAtIndex: index, NextPageToken: page.NextPageToken}
+	for _, item := range page.Items {
+		kv, err := entryToKeyValue(item.Key, item.Entry, req.GetType())
+		if err == nil {
+			err = projectKeyValue(kv, item.Entry, req.GetFields())
+		}
+		if err != nil {
+			return nil, toStatus(decodeError(err))
+		}
+		resp.Kvs = append(resp.Kvs, kv)
+	}
+	return resp, nil
+}
+
+func (r rpcInterface) BeginTransaction(ctx context.Context, req *pb.BeginTransactionRequest) (*pb.BeginTransactionResponse, error) {
+	ttl := normalizeTrxTTL(time.Duration(req.GetTtlSeconds()) * time.Second)
+	index, resp, err := applyCommand(ctx, r.raft, &Command{
+		OpType: OpTrx,
+		TTL:    int64(ttl),
+	})
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	trxID, ok := resp.(uint64)
+	if !ok {
+		return nil, status.Errorf(codes.Internal, "unexpected response %v", resp)
+	}
+	return &pb.BeginTransactionResponse{
+		TrxId:       trxID,
+		CommitIndex: index,
+		TtlSeconds:  uint32(ttl / time.Second),
+	}, nil
+}
+
+func (r rpcInterface) KeepAliveTransaction(ctx context.Context, req *pb.KeepAliveTransactionRequest) (*pb.KeepAliveTransactionResponse, error) {
+	index, resp, err := applyCommand(ctx, r.raft, &Command{
+		OpType: OpTrxKeepAlive,
+		TrxID:  req.GetTrxId(),
+	})
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	info, ok := resp.(*TrxInfo)
+	if !ok {
+		return nil, status.Errorf(codes.Internal, "unexpected response %v", resp)
+	}
+	return &pb.KeepAliveTransactionResponse{CommitIndex: index, TtlSeconds: uint32(info.TTL)}, nil
+}
+
+func (r rpcInterface) Commit(ctx context.Context, req *pb.CommitRequest) (*pb.CommitResponse, error) {
+	index, _, err := applyCommand(ctx, r.raft, &Command{OpType: OpCmt, TrxID: req.GetTrxId()})
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &pb.CommitResponse{CommitIndex: index}, nil
+}
+
+func (r rpcInterface) Rollback(ctx context.Context, req *pb.RollbackRequest) (*pb.RollbackResponse, error) {
+	index, _, err := applyCommand(ctx, r.raft, &Command{OpType: OpRol, TrxID: req.GetTrxId()})
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &pb.RollbackResponse{CommitIndex: index}, nil
+}
+
+func (r rpcInterface) Batch(ctx context.Context, req *pb.BatchRequest) (*pb.BatchResponse, error) {
+	ops := make([]*Command, 0, len(req.GetOps()))
+	for i, op := range req.GetOps() {
+		switch op.GetOp() {
+		case pb.BatchOperation_PUT:
+			valueType, value, err := ValueToBytes(op.GetValue())
+			if err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "ops[%d]: %v", i, err)
+			}
+			if op.GetTtlSeconds() < 0 {
+				return nil, status.Errorf(codes.InvalidArgument, "ops[%d]: ttl_seconds must not be negative", i)
+			}
+			ops = append(ops, &Command{
+				OpType:    OpPut,
+				Key:       op.GetKey(),
+				Value:     value,
+				ValueType: valueType,
+				TTL:       keyTTL(op.GetTtlSeconds()),
+				LeaseID:   op.GetLease(),
+			})
+		case pb.BatchOperation_DELETE:
+			ops = append(ops, &Command{OpType: OpDel, Key: op.GetKey()})
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "ops[%d]: unsupported operation %v", i, op.GetOp())
+		}
+		if err := setCondition(ops[len(ops)-1], op.GetCondition()); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "ops[%d]: %v", i, err)
+		}
+	}
+	_, resp, err := applyCommand(ctx, r.raft, &Command{
+		OpType: OpBatch,
+		TrxID:  req.GetTrxId(),
+		Ops:    ops,
+	})
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	result, ok := resp.(*BatchResult)
+	if !ok {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("unexpected response %v", resp))
+	}
+	out := &pb.BatchResponse{
+		CommitIndex: result.Index,
+		Committed:   result.Committed,
+	}
+	for _, res := range result.Results {
+		out.Results = append(out.Results, &pb.BatchOperationResult{
+			Key:   []byte(res.Key),
+			Error: res.Error,
+		})
+	}
+	return out, nil
+}
+
+func leaseToProto(info *LeaseInfo) *pb.Lease {
+	l := &pb.Lease{
+		Id:         info.ID,
+		TtlSeconds: uint32(info.TTL),
+		GrantedAt:  info.GrantedAt.UnixNano(),
+		Deadline:   info.Deadline.UnixNano(),
+	}
+	for _, key := range info.Keys {
+		l.Keys = append(l.Keys, []byte(key))
+	}
+	return l
+}
+
+func (r rpcInterface) LeaseGrant(ctx context.Context, req *pb.LeaseGrantRequest) (*pb.LeaseGrantResponse, error) {
+	index, resp, err := applyCommand(ctx, r.raft, &Command{
+		OpType: OpLeaseGrant,
+		TTL:    int64(normalizeLeaseTTL(time.Duration(req.GetTtlSeconds()) * time.Second)),
+	})
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	info, ok := resp.(*LeaseInfo)
+	if !ok {
+		return nil, status.Errorf(codes.Internal, "unexpected response %v", resp)
+	}
+	return &pb.LeaseGrantResponse{Lease: leaseToProto(info), CommitIndex: index}, nil
+}
+
+func (r rpcInterface) LeaseRevoke(ctx context.Context, req *pb.LeaseRevokeRequest) (*pb.LeaseRevokeResponse, error) {
+	index, _, err := applyCommand(ctx, r.raft, &Command{OpType: OpLeaseRevoke, LeaseID: req.GetId()})
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &pb.LeaseRevokeResponse{CommitIndex: index}, nil
+}
+
+func (r rpcInterface) LeaseKeepAlive(ctx context.Context, req *pb.LeaseKeepAliveRequest) (*pb.LeaseKeepAliveResponse, error) {
+	index, resp, err := applyCommand(ctx, r.raft, &Command{
+		OpType:  OpLeaseKeepAlive,
+		LeaseID: req.GetId(),
+	})
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	info, ok := resp.(*LeaseInfo)
+	if !ok {
+		return nil, status.Errorf(codes.Internal, "unexpected response %v", resp)
+	}
+	return &pb.LeaseKeepAliveResponse{Lease: leaseToProto(info), CommitIndex: index}, nil
+}
+
+func (r rpcInterface) Leases(ctx context.Context, req *pb.LeasesRequest) (*pb.LeasesResponse, error) {
+	resp := &pb.LeasesResponse{}
+	for _, info := range r.drifterX.Leases() {
+		info := info
+		resp.Leases = append(resp.Leases, leaseToProto(&info))
+	}
+	return resp, nil
+}
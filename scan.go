@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"math"
+
+	"github.com/LaJunkai/drifterdb"
+)
+
+const (
+	// DefaultRangeLimit is the page size used when a range request sets no limit.
+	DefaultRangeLimit = 100
+	// MaxRangeLimit caps the page size of a single range request.
+	MaxRangeLimit = 1000
+)
+
+// pageTokenVersion prefixes every continuation token so the format can change.
+const pageTokenVersion = 1
+
+var errBadPageToken = errors.New("invalid continuation token")
+
+// rangeReader is implemented by drifterdb.BaseDB. drifterdb 的 Range 返回
+// [start, end) 内按 key 升序排列的元素，offset/count 用于跳过和截断。
+type rangeReader interface {
+	Range(start, end []byte, offset, count int) []*drifterdb.Element
+}
+
+// RangeQuery describes one page of a range scan.
+type RangeQuery struct {
+	// StartKey is inclusive, EndKey exclusive. An empty EndKey means the end
+	// of the keyspace.
+	StartKey []byte
+	EndKey   []byte
+	// Prefix further restricts the scan to keys starting with it.
+	Prefix  []byte
+	Reverse bool
+	Limit   int
+	// PageToken continues a previous scan with the same bounds and order.
+	PageToken string
+	// Now (unix nano) skips keys that expired at that time; 0 returns them.
+	Now int64
+}
+
+// RangeItem is a key together with its decoded entry.
+type RangeItem struct {
+	Key   []byte
+	Entry *entry
+}
+
+// RangePage is the result of a range scan. NextPageToken is empty when the
+// scan reached the end of the range.
+type RangePage struct {
+	Items         []RangeItem
+	NextPageToken string
+}
+
+// scanRange reads one page of q from db.
+//
+// drifterdb 只支持升序遍历，倒序时需要取出区间内的全部元素后再反转，
+// 因此倒序扫描的开销与区间大小成正比。
+func scanRange(db rangeReader, q RangeQuery) (*RangePage, error) {
+	start, end := q.StartKey, q.EndKey
+	if len(end) == 0 {
+		end = keyspaceEnd
+	}
+	if len(q.Prefix) > 0 {
+		if bytes.Compare(q.Prefix, start) > 0 {
+			start = q.Prefix
+		}
+		if pe := prefixEnd(q.Prefix); pe != nil && bytes.Compare(pe, end) < 0 {
+			end = pe
+		}
+	}
+	if q.PageToken != "" {
+		last, err := decodePageToken(q.PageToken)
+		if err != nil {
+			return nil, err
+		}
+		if q.Reverse {
+			end = last
+		} else {
+			// 紧跟在 last 之后的最小 key
+			start = append(append([]byte(nil), last...), 0)
+		}
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultRangeLimit
+	}
+	if limit > MaxRangeLimit {
+		limit = MaxRangeLimit
+	}
+	page := &RangePage{}
+	if bytes.Compare(start, end) >= 0 {
+		return page, nil
+	}
+	var elements []*drifterdb.Element
+	if q.Reverse {
+		all := db.Range(start, end, 0, math.MaxInt32)
+		for i := len(all) - 1; i >= 0 && len(elements) <= limit; i-- {
+			elements = append(elements, all[i])
+		}
+	} else {
+		elements = db.Range(start, end, 0, limit+1)
+	}
+	if len(elements) > limit {
+		elements = elements[:limit]
+		page.NextPageToken = encodePageToken(elements[limit-1].Key().([]byte))
+	}
+	page.Items = make([]RangeItem, 0, len(elements))
+	for _, el := range elements {
+		e, err := decodeEntry(el.Value())
+		if err != nil {
+			return nil, err
+		}
+		if e.expired(q.Now) {
+			// 过期的 key 不计入结果，页面可能因此少于 limit 条
+			continue
+		}
+		page.Items = append(page.Items, RangeItem{Key: el.Key().([]byte), Entry: e})
+	}
+	return page, nil
+}
+
+// prefixEnd returns the smallest key greater than every key with the given
+// prefix, or nil if there is none.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+func encodePageToken(lastKey []byte) string {
+	return base64.RawURLEncoding.EncodeToString(append([]byte{pageTokenVersion}, lastKey...))
+}
+
+func decodePageToken(token string) ([]byte, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(b) == 0 || b[0] != pageTokenVersion {
+		return nil, errBadPageToken
+	}
+	return b[1:], nil
+}
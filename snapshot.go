@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math"
+
+	"github.com/LaJunkai/drifterdb"
+	"github.com/hashicorp/raft"
+)
+
+// 快照文件格式：
+//
+//	magic(4 bytes "DRXS") | version(1 byte) | record* | end record | crc32(4 bytes, big endian)
+//
+// 每条 record 为 kind(1 byte) | uvarint(len(key)) | key | uvarint(len(value)) | value，
+// end record 只有一个值为 recordEnd 的 kind 字节。crc32 覆盖其之前的全部字节。
+const (
+	snapshotMagic   = "DRXS"
+	snapshotVersion = 1
+)
+
+const (
+	recordEnd = iota
+	recordKV
+	recordTrx   // 未提交的事务，key 为事务 ID，value 见 DrifterX.snapshotTransactions
+	recordLease // 租约，key 为租约 ID，value 见 DrifterX.snapshotLeases
+	recordNode  // 节点地址，key 为节点 ID，value 见 DrifterX.snapshotNodes
+	// 事务写入的 entry，key 为事务 ID 与 key，value 见 DrifterX.snapshotTransactions
+	recordTrxEntry
+)
+
+// keyspaceEnd is the exclusive upper bound used when iterating the whole
+// keyspace. Keys sorting at or after it are exactly those starting with it,
+// writeEntry rejects them so that scans and snapshots see every stored key.
+var keyspaceEnd = bytes.Repeat([]byte{0xff}, 256)
+
+var errReservedKey = errors.New("keys starting with 256 0xff bytes are reserved")
+
+// checkKey reports whether key may be written.
+func checkKey(key []byte) error {
+	if bytes.HasPrefix(key, keyspaceEnd) {
+		return errReservedKey
+	}
+	return nil
+}
+
+var errSnapshotChecksum = errors.New("snapshot checksum mismatch")
+
+type snapshotRecord struct {
+	kind  byte
+	key   []byte
+	value []byte
+}
+
+// scanAll returns a copy of every key/value pair currently stored in db.
+func scanAll(db drifterdb.BaseDB) []snapshotRecord {
+	elements := db.Range([]byte{}, keyspaceEnd, 0, math.MaxInt32)
+	records := make([]snapshotRecord, 0, len(elements))
+	for _, e := range elements {
+		records = append(records, snapshotRecord{
+			kind:  recordKV,
+			key:   append([]byte(nil), e.Key().([]byte)...),
+			value: append([]byte(nil), e.Value()...),
+		})
+	}
+	return records
+}
+
+type snapshot struct {
+	records []snapshotRecord
+}
+
+func (s *snapshot) Persist(sink raft.SnapshotSink) error {
+	if err := writeSnapshot(sink, s.records); err != nil {
+		sink.Cancel()
+		return fmt.Errorf("writeSnapshot(): %v", err)
+	}
+	return sink.Close()
+}
+
+func (s *snapshot) Release() {
+}
+
+func writeSnapshot(w io.Writer, records []snapshotRecord) error {
+	crc := crc32.NewIEEE()
+	bw := bufio.NewWriter(io.MultiWriter(w, crc))
+	if _, err := bw.WriteString(snapshotMagic); err != nil {
+		return err
+	}
+	if err := bw.WriteByte(snapshotVersion); err != nil {
+		return err
+	}
+	for _, rec := range records {
+		if err := bw.WriteByte(rec.kind); err != nil {
+			return err
+		}
+		if err := writeBytes(bw, rec.key); err != nil {
+			return err
+		}
+		if err := writeBytes(bw, rec.value); err != nil {
+			return err
+		}
+	}
+	if err := bw.WriteByte(recordEnd); err != nil {
+		return err
+	}
+	// crc 只覆盖 trailer 之前的内容，因此先 flush 再取值
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	trailer := make([]byte, 4)
+	binary.BigEndian.PutUint32(trailer, crc.Sum32())
+	_, err := w.Write(trailer)
+	return err
+}
+
+func readSnapshot(r io.Reader) ([]snapshotRecord, error) {
+	crc := crc32.NewIEEE()
+	br := bufio.NewReader(r)
+	cr := &checksumReader{r: br, h: crc}
+	header := make([]byte, len(snapshotMagic)+1)
+	if _, err := io.ReadFull(cr, header); err != nil {
+		return nil, fmt.Errorf("reading snapshot header: %v", err)
+	}
+	if string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return nil, errors.New("not a drifterx snapshot")
+	}
+	if v := header[len(snapshotMagic)]; v != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", v)
+	}
+	var records []snapshotRecord
+	for {
+		kind, err := cr.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("reading snapshot record: %v", err)
+		}
+		if kind == recordEnd {
+			break
+		}
+		rec := snapshotRecord{kind: kind}
+		if rec.key, err = readBytes(cr); err != nil {
+			return nil, fmt.Errorf("reading snapshot record: %v", err)
+		}
+		if rec.value, err = readBytes(cr); err != nil {
+			return nil, fmt.Errorf("reading snapshot record: %v", err)
+		}
+		records = append(records, rec)
+	}
+	sum := crc.Sum32()
+	trailer := make([]byte, 4)
+	if _, err := io.ReadFull(br, trailer); err != nil {
+		return nil, fmt.Errorf("reading snapshot checksum: %v", err)
+	}
+	if binary.BigEndian.Uint32(trailer) != sum {
+		return nil, errSnapshotChecksum
+	}
+	return records, nil
+}
+
+func writeBytes(w *bufio.Writer, b []byte) error {
+	lenBuf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(lenBuf, uint64(len(b)))
+	if _, err := w.Write(lenBuf[:n]); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+func readBytes(r *checksumReader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > math.MaxInt32 {
+		return nil, fmt.Errorf("record length %d too large", n)
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	return b, err
+}
+
+// checksumReader feeds every byte it reads into h.
+type checksumReader struct {
+	r *bufio.Reader
+	h hash.Hash32
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.h.Write(p[:n])
+	return n, err
+}
+
+func (c *checksumReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.h.Write([]byte{b})
+	}
+	return b, err
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+// TestSnapshotCatchUp truncates the log behind a snapshot and checks that a
+// node joining afterwards converges by installing that snapshot.
+func TestSnapshotCatchUp(t *testing.T) {
+	c := newTestCluster(t, 1, func(conf *raft.Config) {
+		conf.SnapshotThreshold = 8
+		conf.TrailingLogs = 4
+	})
+	defer c.shutdown()
+
+	var keys [][]byte
+	for i := 0; i < 32; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("key-%02d", i)))
+	}
+	// 排在 keyspaceEnd 之前的最大的 key 也必须进入快照
+	keys = append(keys, append(bytes.Repeat([]byte{0xff}, 255), 0xfe), bytes.Repeat([]byte{0xff}, 255))
+	for i, key := range keys {
+		if _, err := c.apply(&Command{OpType: OpPut, Key: key, Value: []byte(strconv.Itoa(i))}); err != nil {
+			t.Fatalf("put %q: %v", key, err)
+		}
+	}
+	// 覆盖写入，使快照中的 version 与 revision 不同于初始值
+	if _, err := c.apply(&Command{OpType: OpPut, Key: keys[0], Value: []byte("again")}); err != nil {
+		t.Fatalf("put %q: %v", keys[0], err)
+	}
+
+	reserved := append(bytes.Repeat([]byte{0xff}, 256), 'x')
+	_, err := c.apply(&Command{OpType: OpPut, Key: reserved, Value: []byte("lost")})
+	if code := toAPIError(err).Code; code != CodeInvalidArgument {
+		t.Fatalf("put of a reserved key: got %v (%v), want %s", code, err, CodeInvalidArgument)
+	}
+
+	leader := c.leader()
+	if err := leader.raft.Snapshot().Error(); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	if first, _ := leader.logs.FirstIndex(); first <= 1 {
+		t.Fatalf("log was not truncated, first index %d", first)
+	}
+
+	follower := c.addNode()
+	c.waitFor("the new node to catch up", func() bool {
+		return follower.raft.AppliedIndex() >= leader.raft.AppliedIndex()
+	})
+	if follower.raft.Stats()["last_snapshot_index"] == "0" {
+		t.Errorf("new node did not install a snapshot")
+	}
+	for _, key := range keys {
+		want, got := leader.fsm.db.Get(key), follower.fsm.db.Get(key)
+		if want == nil {
+			t.Errorf("key %q missing on the leader", key)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("key %q: new node has %q, leader %q", key, got, want)
+		}
+	}
+	if got := follower.fsm.db.Get(reserved); got != nil {
+		t.Errorf("reserved key was stored: %q", got)
+	}
+}
+
+// TestSnapshotOpenTransaction checks that a node installing a snapshot sees
+// the writes of an open transaction as they were made, even though the data
+// they were computed from changed afterwards.
+func TestSnapshotOpenTransaction(t *testing.T) {
+	c := newTestCluster(t, 1, func(conf *raft.Config) {
+		conf.TrailingLogs = 1
+	})
+	defer c.shutdown()
+
+	res, err := c.apply(&Command{OpType: OpTrx})
+	if err != nil {
+		t.Fatalf("starting a transaction: %v", err)
+	}
+	trxID := res.(uint64)
+	key := []byte("counter")
+	if _, err := c.apply(&Command{OpType: OpIncr, Key: key, Delta: 1, TrxID: trxID}); err != nil {
+		t.Fatalf("incr in transaction: %v", err)
+	}
+	if _, err := c.apply(&Command{OpType: OpIncr, Key: key, Delta: 10}); err != nil {
+		t.Fatalf("incr: %v", err)
+	}
+	leader := c.leader()
+	if err := leader.raft.Snapshot().Error(); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+
+	follower := c.addNode()
+	c.waitFor("the new node to catch up", func() bool {
+		return follower.raft.AppliedIndex() >= leader.raft.AppliedIndex()
+	})
+	if follower.raft.Stats()["last_snapshot_index"] == "0" {
+		t.Fatalf("new node did not install a snapshot")
+	}
+	trx := follower.fsm.transaction(trxID)
+	if trx == nil {
+		t.Fatalf("transaction %d was not restored", trxID)
+	}
+	if got, want := trx.Get(key), leader.fsm.transaction(trxID).Get(key); !bytes.Equal(got, want) {
+		t.Errorf("transaction view after restore: got %q, want %q", got, want)
+	}
+
+	if _, err := c.apply(&Command{OpType: OpCmt, TrxID: trxID}); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	c.waitFor("the commit to replicate", func() bool {
+		return follower.raft.AppliedIndex() >= leader.raft.AppliedIndex()
+	})
+	if got, want := follower.fsm.db.Get(key), leader.fsm.db.Get(key); !bytes.Equal(got, want) {
+		t.Errorf("committed value on the new node: got %q, want %q", got, want)
+	}
+}
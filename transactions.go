@@ -0,0 +1,313 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/LaJunkai/drifterdb"
+)
+
+const (
+	// DefaultTrxTTL is the lease of a transaction whose client did not ask for one.
+	DefaultTrxTTL = 30 * time.Second
+	// MaxTrxTTL caps the lease a client may request.
+	MaxTrxTTL = time.Hour
+)
+
+// openTrx is the FSM-side state of an open transaction.
+//
+// 事务 ID 是开启事务的那条日志的 index，与 drifterdb 本地分配的事务号无关，
+// 因此所有副本上同一个 ID 指向同一个事务。trx 是本地 drifterdb 事务，
+// ops 记录已写入该事务的操作，提交时据此通知 watcher。
+//
+// 所有时间都来自日志中命令携带的 Time（由 leader 在提交时写入），而不是本地时钟，
+// 因此每个副本得到的租约状态完全一致。
+type openTrx struct {
+	trx       *drifterdb.Transaction
+	ops       []*Command
+	startedAt int64 // unix nano
+	deadline  int64 // unix nano
+	ttl       time.Duration
+}
+
+// TrxInfo describes an open transaction, see GET /db/transactions.
+type TrxInfo struct {
+	TrxID     uint64    `json:"trx_id"`
+	StartedAt time.Time `json:"started_at"`
+	Deadline  time.Time `json:"deadline"`
+	TTL       float64   `json:"ttl"` // 秒
+	Age       float64   `json:"age"` // 秒
+	Ops       int       `json:"ops"`
+}
+
+func normalizeTrxTTL(ttl time.Duration) time.Duration {
+	if ttl <= 0 {
+		return DefaultTrxTTL
+	}
+	if ttl > MaxTrxTTL {
+		return MaxTrxTTL
+	}
+	return ttl
+}
+
+// startTransaction opens a drifterdb transaction for the OpTrx command at
+// index and returns its id.
+func (x *DrifterX) startTransaction(index uint64, c *Command) uint64 {
+	ttl := normalizeTrxTTL(time.Duration(c.TTL))
+	trx := x.db.StartTransaction()
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	t := &openTrx{trx: trx, ttl: ttl}
+	// 旧版本的命令不带时间，这类事务的租约从下一条引用它的带时间的命令开始计算
+	if c.Time != 0 {
+		t.startedAt = c.Time
+		t.deadline = c.Time + int64(ttl)
+	}
+	x.trxs[index] = t
+	if c.legacy {
+		// 旧版本的日志使用 drifterdb 分配的事务号引用事务
+		x.legacyTrxs[trx.TrxID()] = index
+	}
+	return index
+}
+
+// resolveTrxID translates the transaction id of a command written by an older
+// version, which referenced transactions by their drifterdb number.
+func (x *DrifterX) resolveTrxID(c *Command) {
+	if !c.legacy || c.TrxID == 0 {
+		return
+	}
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	c.TrxID = x.legacyTrxs[uint32(c.TrxID)]
+}
+
+// transaction returns the local drifterdb transaction of id, or nil.
+func (x *DrifterX) transaction(id uint64) *drifterdb.Transaction {
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	if t, ok := x.trxs[id]; ok {
+		return t.trx
+	}
+	return nil
+}
+
+// recordTransactionOps remembers operations applied in transaction id.
+func (x *DrifterX) recordTransactionOps(id uint64, ops ...*Command) {
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	if t, ok := x.trxs[id]; ok {
+		t.ops = append(t.ops, ops...)
+	}
+}
+
+// endTransaction commits or rolls back transaction id. The writes of a
+// committed transaction are published to watchers at revision rev.
+func (x *DrifterX) endTransaction(id uint64, rev uint64, commit bool) error {
+	x.mtx.Lock()
+	t, ok := x.trxs[id]
+	delete(x.trxs, id)
+	x.mtx.Unlock()
+	if !ok {
+		return errTrxNotFound
+	}
+	if commit {
+		x.publishChanges(rev, commandKeys(t.ops), func() error {
+			x.db.CommitTransactionByID(t.trx.TrxID())
+			return nil
+		})
+	} else {
+		x.db.RollbackTransactionByID(t.trx.TrxID())
+	}
+	return nil
+}
+
+// keepAliveTransaction renews the lease of a transaction and returns its info.
+func (x *DrifterX) keepAliveTransaction(c *Command) (*TrxInfo, error) {
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	t, ok := x.trxs[c.TrxID]
+	if !ok {
+		return nil, errTrxNotFound
+	}
+	t.stamp(c.Time)
+	if t.deadline < c.Time+int64(t.ttl) {
+		t.deadline = c.Time + int64(t.ttl)
+	}
+	info := t.info(c.TrxID, c.Time)
+	return &info, nil
+}
+
+// expireTransaction rolls back a transaction whose lease ran out before c.Time.
+// A lease renewed after the leader decided to expire it is left alone.
+func (x *DrifterX) expireTransaction(c *Command) bool {
+	x.mtx.Lock()
+	t, ok := x.trxs[c.TrxID]
+	expired := ok && !t.stamp(c.Time) && t.deadline <= c.Time
+	x.mtx.Unlock()
+	if expired {
+		x.endTransaction(c.TrxID, c.Revision, false)
+	}
+	return expired
+}
+
+// Transactions lists the open transactions ordered by id.
+func (x *DrifterX) Transactions(now time.Time) []TrxInfo {
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	res := make([]TrxInfo, 0, len(x.trxs))
+	for id, t := range x.trxs {
+		res = append(res, t.info(id, now.UnixNano()))
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].TrxID < res[j].TrxID })
+	return res
+}
+
+// expiredTransactions returns the ids of transactions whose lease ran out at now.
+func (x *DrifterX) expiredTransactions(now time.Time) []uint64 {
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	var ids []uint64
+	for id, t := range x.trxs {
+		if t.deadline <= now.UnixNano() {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// stamp starts the lease of a transaction opened by a command without a time
+// at now, and reports whether it did.
+func (t *openTrx) stamp(now int64) bool {
+	if t.startedAt != 0 || now == 0 {
+		return false
+	}
+	t.startedAt = now
+	t.deadline = now + int64(t.ttl)
+	return true
+}
+
+func (t *openTrx) info(id uint64, now int64) TrxInfo {
+	return TrxInfo{
+		TrxID:     id,
+		StartedAt: time.Unix(0, t.startedAt),
+		Deadline:  time.Unix(0, t.deadline),
+		TTL:       t.ttl.Seconds(),
+		Age:       time.Duration(now - t.startedAt).Seconds(),
+		Ops:       len(t.ops),
+	}
+}
+
+// snapshotTransactions encodes every open transaction as snapshot records.
+// The records reuse the command encoding: a recordTrx holds an OpTrx command
+// whose Ops are the operations written so far and whose Value holds the lease
+// deadline; it is followed by a recordTrxEntry for every key the transaction
+// wrote, holding an OpPut of the stored entry or an OpDel if the transaction
+// deleted the key.
+//
+// 事务内写入的结果依赖于写入时的数据（计数器、JSON 文档、version 等），
+// 因此快照保存写入后的 entry 原文，恢复时原样写回，而不是重放操作。
+func (x *DrifterX) snapshotTransactions() []snapshotRecord {
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	ids := make([]uint64, 0, len(x.trxs))
+	for id := range x.trxs {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	var records []snapshotRecord
+	for _, id := range ids {
+		t := x.trxs[id]
+		c := &Command{
+			OpType: OpTrx,
+			TrxID:  id,
+			Value:  appendUvarint(nil, uint64(t.deadline)),
+			Time:   t.startedAt,
+			TTL:    int64(t.ttl),
+			Ops:    append([]*Command(nil), t.ops...),
+		}
+		records = append(records, snapshotRecord{
+			kind:  recordTrx,
+			key:   appendUvarint(nil, id),
+			value: encodeCommand(c),
+		})
+		written := map[string]bool{}
+		for _, key := range commandKeys(t.ops) {
+			if written[string(key)] {
+				continue
+			}
+			written[string(key)] = true
+			e := &Command{OpType: OpDel, TrxID: id, Key: key}
+			if value := t.trx.Get(key); len(value) > 0 {
+				e.OpType, e.Value = OpPut, value
+			}
+			records = append(records, snapshotRecord{
+				kind:  recordTrxEntry,
+				key:   append(appendUvarint(nil, id), key...),
+				value: encodeCommand(e),
+			})
+		}
+	}
+	return records
+}
+
+// resetTransactions rolls back every open drifterdb transaction and forgets
+// all transaction state, ahead of a snapshot restore.
+func (x *DrifterX) resetTransactions() {
+	x.mtx.Lock()
+	trxs := x.trxs
+	x.trxs = map[uint64]*openTrx{}
+	x.legacyTrxs = map[uint32]uint64{}
+	x.mtx.Unlock()
+	for _, t := range trxs {
+		x.db.RollbackTransactionByID(t.trx.TrxID())
+	}
+}
+
+// restoreTransaction reopens a transaction saved by snapshotTransactions and
+// writes back the entries it had written, given by transaction id. The new
+// drifterdb transaction sees the restored data as its starting point.
+func (x *DrifterX) restoreTransaction(rec snapshotRecord, entries map[uint64][]*Command) error {
+	c, err := decodeCommand(rec.value)
+	if err != nil {
+		return fmt.Errorf("decoding transaction record: %v", err)
+	}
+	deadline, err := uintPayload(c.Value)
+	if err != nil {
+		return errors.New("decoding transaction record: bad deadline")
+	}
+	t := &openTrx{
+		trx:       x.db.StartTransaction(),
+		ops:       c.Ops,
+		startedAt: c.Time,
+		deadline:  int64(deadline),
+		ttl:       time.Duration(c.TTL),
+	}
+	for _, e := range entries[c.TrxID] {
+		if e.OpType == OpDel {
+			err = t.trx.Delete(e.Key)
+		} else {
+			err = t.trx.Put(e.Key, e.Value)
+		}
+		if err != nil {
+			return fmt.Errorf("restoring transaction %d: %v", c.TrxID, err)
+		}
+	}
+	x.mtx.Lock()
+	x.trxs[c.TrxID] = t
+	x.mtx.Unlock()
+	return nil
+}
+
+// restoreTransactionEntry decodes a recordTrxEntry into entries.
+func restoreTransactionEntry(rec snapshotRecord, entries map[uint64][]*Command) error {
+	e, err := decodeCommand(rec.value)
+	if err != nil {
+		return fmt.Errorf("decoding transaction entry: %v", err)
+	}
+	entries[e.TrxID] = append(entries[e.TrxID], e)
+	return nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/LaJunkai/drifterdb"
+	"github.com/hashicorp/raft"
+)
+
+// TestTransactionWithoutTime checks that the lease of a transaction opened by
+// a command without a time, as written by older versions, starts with the
+// first command that carries one instead of having run out long ago.
+func TestTransactionWithoutTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drifterx-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	x := NewDrifterX(drifterdb.OpenDB(dir))
+	var index uint64
+	apply := func(c *Command) interface{} {
+		index++
+		return x.Apply(&raft.Log{Index: index, Data: encodeCommand(c)})
+	}
+
+	trxID := apply(&Command{OpType: OpTrx, TTL: int64(time.Minute)}).(uint64)
+	now := time.Now()
+	if apply(&Command{OpType: OpTrxExpire, TrxID: trxID, Time: now.UnixNano()}).(bool) {
+		t.Fatalf("transaction expired at its first command with a time")
+	}
+	if apply(&Command{OpType: OpTrxExpire, TrxID: trxID, Time: now.Add(30 * time.Second).UnixNano()}).(bool) {
+		t.Fatalf("transaction expired before its lease ran out")
+	}
+	if !apply(&Command{OpType: OpTrxExpire, TrxID: trxID, Time: now.Add(time.Minute).UnixNano()}).(bool) {
+		t.Fatalf("transaction did not expire after its lease ran out")
+	}
+}
+
+// TestCommitExpiredTransaction checks that a transaction whose lease ran out
+// cannot be committed before the leader got around to expiring it.
+func TestCommitExpiredTransaction(t *testing.T) {
+	c := newTestCluster(t, 1, nil)
+	defer c.shutdown()
+
+	res, err := c.apply(&Command{OpType: OpTrx, TTL: int64(time.Millisecond)})
+	if err != nil {
+		t.Fatalf("starting a transaction: %v", err)
+	}
+	trxID := res.(uint64)
+	if _, err := c.apply(&Command{OpType: OpPut, Key: []byte("k"), Value: []byte("v"), TrxID: trxID}); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	_, err = c.apply(&Command{OpType: OpCmt, TrxID: trxID})
+	if code := toAPIError(err).Code; code != CodeTxnNotFound {
+		t.Fatalf("commit of an expired transaction: got %v, want %s", err, CodeTxnNotFound)
+	}
+	if v := c.leader().fsm.db.Get([]byte("k")); v != nil {
+		t.Errorf("write of the expired transaction was committed: %q", v)
+	}
+}
+
+// TestTransactionIsolation checks that a transaction reads its own writes on
+// every replica while they stay invisible outside of it, including to other
+// transactions, until it commits.
+func TestTransactionIsolation(t *testing.T) {
+	c := newTestCluster(t, 3, nil)
+	defer c.shutdown()
+
+	for _, op := range []*Command{
+		{OpType: OpPut, Key: []byte("changed"), Value: []byte("old")},
+		{OpType: OpPut, Key: []byte("deleted"), Value: []byte("old")},
+	} {
+		if _, err := c.apply(op); err != nil {
+			t.Fatalf("put %s: %v", op.Key, err)
+		}
+	}
+	begin := func() uint64 {
+		res, err := c.apply(&Command{OpType: OpTrx, TTL: int64(time.Minute)})
+		if err != nil {
+			t.Fatalf("starting a transaction: %v", err)
+		}
+		return res.(uint64)
+	}
+	trxID, other := begin(), begin()
+	for _, op := range []*Command{
+		{OpType: OpPut, Key: []byte("added"), Value: []byte("new"), TrxID: trxID},
+		{OpType: OpPut, Key: []byte("changed"), Value: []byte("new"), TrxID: trxID},
+		{OpType: OpDel, Key: []byte("deleted"), TrxID: trxID},
+	} {
+		if _, err := c.apply(op); err != nil {
+			t.Fatalf("op %d on %s: %v", op.OpType, op.Key, err)
+		}
+	}
+	want := func(r kvReader, key, value string) bool {
+		e, err := getEntry(r, []byte(key))
+		if err != nil {
+			t.Fatalf("reading %s: %v", key, err)
+		}
+		if value == "" {
+			return e == nil
+		}
+		return e != nil && string(e.Value) == value
+	}
+	for _, node := range c.nodes {
+		node := node
+		c.waitFor("the transaction on "+string(node.id), func() bool {
+			trx := node.fsm.transaction(trxID)
+			return trx != nil && want(trx, "added", "new") && want(trx, "changed", "new") && want(trx, "deleted", "")
+		})
+		for _, r := range []struct {
+			name   string
+			reader kvReader
+		}{{"the database", node.fsm.db}, {"another transaction", node.fsm.transaction(other)}} {
+			if !want(r.reader, "added", "") || !want(r.reader, "changed", "old") || !want(r.reader, "deleted", "old") {
+				t.Errorf("uncommitted writes are visible to %s on %s", r.name, node.id)
+			}
+		}
+	}
+
+	if _, err := c.apply(&Command{OpType: OpCmt, TrxID: trxID}); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	for _, node := range c.nodes {
+		node := node
+		c.waitFor("the commit on "+string(node.id), func() bool {
+			return want(node.fsm.db, "added", "new") && want(node.fsm.db, "changed", "new") && want(node.fsm.db, "deleted", "")
+		})
+	}
+}
+
+// TestTransactionRollback checks that nothing a rolled back transaction wrote
+// remains and that the transaction cannot be used afterwards.
+func TestTransactionRollback(t *testing.T) {
+	c := newTestCluster(t, 3, nil)
+	defer c.shutdown()
+
+	if _, err := c.apply(&Command{OpType: OpPut, Key: []byte("kept"), Value: []byte("old")}); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	res, err := c.apply(&Command{OpType: OpTrx, TTL: int64(time.Minute)})
+	if err != nil {
+		t.Fatalf("starting a transaction: %v", err)
+	}
+	trxID := res.(uint64)
+	for _, op := range []*Command{
+		{OpType: OpPut, Key: []byte("added"), Value: []byte("new"), TrxID: trxID},
+		{OpType: OpPut, Key: []byte("kept"), Value: []byte("new"), TrxID: trxID},
+		{OpType: OpBatch, TrxID: trxID, Ops: []*Command{{OpType: OpPut, Key: []byte("batched"), Value: []byte("new")}}},
+	} {
+		if _, err := c.apply(op); err != nil {
+			t.Fatalf("op %d: %v", op.OpType, err)
+		}
+	}
+	if _, err := c.apply(&Command{OpType: OpRol, TrxID: trxID}); err != nil {
+		t.Fatalf("rollback: %v", err)
+	}
+
+	// 状态机按顺序应用日志，各节点看到回滚之后写入的 key 时回滚一定已经应用
+	if _, err := c.apply(&Command{OpType: OpPut, Key: []byte("marker"), Value: []byte("v")}); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	for _, node := range c.nodes {
+		node := node
+		c.waitFor("the rollback on "+string(node.id), func() bool {
+			return node.fsm.db.Get([]byte("marker")) != nil
+		})
+		if node.fsm.transaction(trxID) != nil {
+			t.Errorf("rolled back transaction is still open on %s", node.id)
+		}
+		for _, key := range []string{"added", "batched"} {
+			if v := node.fsm.db.Get([]byte(key)); v != nil {
+				t.Errorf("%s: rolled back write of %s remains: %q", node.id, key, v)
+			}
+		}
+		if e, err := getEntry(node.fsm.db, []byte("kept")); err != nil || e == nil || string(e.Value) != "old" {
+			t.Errorf("%s: kept: got %+v (%v), want the value from before the transaction", node.id, e, err)
+		}
+	}
+	for _, op := range []*Command{
+		{OpType: OpPut, Key: []byte("added"), Value: []byte("new"), TrxID: trxID},
+		{OpType: OpCmt, TrxID: trxID},
+	} {
+		if _, err := c.apply(op); toAPIError(err).Code != CodeTxnNotFound {
+			t.Errorf("op %d after rollback: got %v, want %s", op.OpType, err, CodeTxnNotFound)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// MaxKeyExpiriesPerCommand bounds the number of keys one OpKeyExpire command
+// deletes, so a burst of expiring keys is spread over several log entries.
+const MaxKeyExpiriesPerCommand = 1000
+
+// keyTTL converts the TTL of a request (seconds, 0 for none) into the TTL of
+// a command.
+func keyTTL(seconds int64) int64 {
+	if seconds <= 0 {
+		return 0
+	}
+	return int64(time.Duration(seconds) * time.Second)
+}
+
+// trackExpiry updates the expiry index after key was committed as e, or
+// deleted when e is nil.
+//
+// 索引只记录已提交的 key 的过期时间，供 leader 找出需要删除的 key。
+// 每个副本都维护这份索引，因此任何节点成为 leader 后都能继续清理。
+func (x *DrifterX) trackExpiry(key []byte, e *entry) {
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	if e == nil || e.ExpiresAt == 0 {
+		delete(x.expiries, string(key))
+		return
+	}
+	x.expiries[string(key)] = e.ExpiresAt
+}
+
+// expiredKeys returns up to limit keys that expired at now, ordered by key.
+func (x *DrifterX) expiredKeys(now time.Time, limit int) [][]byte {
+	x.mtx.Lock()
+	var keys []string
+	for key, expiresAt := range x.expiries {
+		if expiresAt <= now.UnixNano() {
+			keys = append(keys, key)
+		}
+	}
+	x.mtx.Unlock()
+	sort.Strings(keys)
+	if len(keys) > limit {
+		keys = keys[:limit]
+	}
+	res := make([][]byte, len(keys))
+	for i, key := range keys {
+		res[i] = []byte(key)
+	}
+	return res
+}
+
+func keyCommands(keys [][]byte) []*Command {
+	cmds := make([]*Command, len(keys))
+	for i, key := range keys {
+		cmds[i] = &Command{OpType: OpDel, Key: key}
+	}
+	return cmds
+}
+
+// expireKeys applies an OpKeyExpire command at index, deleting those of its
+// keys that expired at c.Time. A key that was written again after the leader
+// proposed the command is left alone. It returns the number of deleted keys.
+func (x *DrifterX) expireKeys(index uint64, c *Command) int {
+	var keys [][]byte
+	for _, op := range c.Ops {
+		if e, err := getEntry(x.db, op.Key); err == nil && e.expired(c.Time) {
+			keys = append(keys, op.Key)
+		}
+	}
+	x.publishChanges(index, keys, func() error {
+		for _, key := range keys {
+			if err := x.db.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return len(keys)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// WatchHistorySize is the number of events kept for watchers that start at a
+// past revision or fall behind.
+const WatchHistorySize = 4096
+
+const (
+	EventPut    = "put"
+	EventDelete = "delete"
+)
+
+// Event is a change of one key. Revision is the log index at which the change
+// became visible; for a write made inside a transaction that is the commit.
+type Event struct {
+	Type     string
+	Key      []byte
+	Revision uint64
+	// Entry is the new entry of a put and nil for a delete.
+	Entry *entry
+}
+
+// CompactedError is returned to a watcher that asks for, or fell behind to, a
+// revision that is no longer in the history. The watcher has to re-read the
+// keys it is interested in and watch again from Revision+1.
+type CompactedError struct {
+	Revision uint64
+}
+
+func (e *CompactedError) Error() string {
+	return fmt.Sprintf("required revision has been compacted, compacted revision is %d", e.Revision)
+}
+
+// WatchFilter selects the keys a watcher is interested in.
+type WatchFilter struct {
+	Key    []byte
+	Prefix bool
+}
+
+func (f WatchFilter) match(key []byte) bool {
+	if f.Prefix {
+		return bytes.HasPrefix(key, f.Key)
+	}
+	return bytes.Equal(key, f.Key)
+}
+
+// watchHub keeps the recent changes applied by the FSM.
+//
+// 事件保存在一个有界的环形缓冲区中，由所有 watcher 共享。watcher 自行记录下一个
+// 需要的 revision 并从缓冲区中拉取，Apply 只负责追加事件，不会因为慢速的消费者
+// 而阻塞。消费速度慢于缓冲区淘汰速度的 watcher 会收到 CompactedError。
+type watchHub struct {
+	mtx     sync.Mutex
+	history []Event // 环形缓冲区，first 为最旧的事件
+	first   int
+	size    int
+	// compacted 及之前的 revision 的事件已不可用
+	compacted uint64
+	// lastRev 是最后一条已应用日志的 index
+	lastRev uint64
+	// restored 表示刚从快照恢复，下一条日志之前的事件均不可用
+	restored bool
+	// changed 在每次追加事件或恢复快照时关闭并替换，用于唤醒等待中的 watcher
+	changed chan struct{}
+}
+
+func newWatchHub() *watchHub {
+	return &watchHub{
+		history: make([]Event, WatchHistorySize),
+		changed: make(chan struct{}),
+	}
+}
+
+// advance records that the log entry at index is being applied.
+func (h *watchHub) advance(index uint64) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if h.restored {
+		h.compacted = index - 1
+		h.restored = false
+	}
+	h.lastRev = index
+}
+
+// publish appends events, all of one revision, to the history.
+func (h *watchHub) publish(events ...Event) {
+	if len(events) == 0 {
+		return
+	}
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	for _, ev := range events {
+		if h.size == len(h.history) {
+			h.evictRevision()
+		}
+		h.history[(h.first+h.size)%len(h.history)] = ev
+		h.size++
+	}
+	h.notify()
+}
+
+// evictRevision drops the oldest revision from the history, so the history
+// never holds only part of the events of a revision.
+func (h *watchHub) evictRevision() {
+	h.compacted = h.at(0).Revision
+	for h.size > 0 && h.at(0).Revision == h.compacted {
+		h.history[h.first] = Event{}
+		h.first = (h.first + 1) % len(h.history)
+		h.size--
+	}
+}
+
+// reset forgets the history after the FSM was restored from a snapshot.
+// Every watcher is told to resynchronise once the next entry is applied.
+func (h *watchHub) reset() {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	for i := range h.history {
+		h.history[i] = Event{}
+	}
+	h.first, h.size = 0, 0
+	h.compacted = h.lastRev
+	h.restored = true
+	h.notify()
+}
+
+func (h *watchHub) notify() {
+	close(h.changed)
+	h.changed = make(chan struct{})
+}
+
+func (h *watchHub) at(i int) *Event {
+	return &h.history[(h.first+i)%len(h.history)]
+}
+
+// startRevision returns the first revision a watcher that asked for rev
+// receives. 0 means the next change.
+func (h *watchHub) startRevision(rev uint64) uint64 {
+	if rev != 0 {
+		return rev
+	}
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	return h.lastRev + 1
+}
+
+// wait returns the events matching f from revision rev on, blocking until
+// there is at least one or ctx is done. next is the revision to continue from.
+func (h *watchHub) wait(ctx context.Context, rev uint64, f WatchFilter) (events []Event, next uint64, err error) {
+	for {
+		h.mtx.Lock()
+		if rev <= h.compacted {
+			h.mtx.Unlock()
+			return nil, rev, &CompactedError{Revision: h.compacted}
+		}
+		i := sort.Search(h.size, func(i int) bool { return h.at(i).Revision >= rev })
+		for ; i < h.size; i++ {
+			ev := h.at(i)
+			if f.match(ev.Key) {
+				events = append(events, *ev)
+			}
+			next = ev.Revision + 1
+		}
+		changed := h.changed
+		h.mtx.Unlock()
+		if next > rev {
+			rev = next
+		}
+		if len(events) > 0 {
+			return events, rev, nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, rev, ctx.Err()
+		}
+	}
+}
+
+// publishChanges runs write, which changes keys in the database at revision
+// rev, and publishes the resulting changes to watchers and to the expiry and
+// lease indexes.
+// Keys that did not exist before and after the write produce no event.
+func (x *DrifterX) publishChanges(rev uint64, keys [][]byte, write func() error) error {
+	prev := make([]*entry, len(keys))
+	for i, key := range keys {
+		prev[i], _ = getEntry(x.db, key)
+	}
+	if err := write(); err != nil {
+		return err
+	}
+	events := make([]Event, 0, len(keys))
+	seen := make(map[string]bool, len(keys))
+	for i, key := range keys {
+		if seen[string(key)] {
+			continue
+		}
+		seen[string(key)] = true
+		next, err := getEntry(x.db, key)
+		if err != nil {
+			continue
+		}
+		x.trackExpiry(key, next)
+		x.trackLease(key, next)
+		switch {
+		case next != nil:
+			events = append(events, Event{Type: EventPut, Key: key, Revision: rev, Entry: next})
+		case prev[i] != nil:
+			events = append(events, Event{Type: EventDelete, Key: key, Revision: rev})
+		}
+	}
+	x.watch.publish(events...)
+	return nil
+}
+
+func commandKeys(cmds []*Command) [][]byte {
+	keys := make([][]byte, len(cmds))
+	for i, c := range cmds {
+		keys[i] = c.Key
+	}
+	return keys
+}